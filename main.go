@@ -20,12 +20,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 
 	vol "github.com/LINBIT/linstor-external-provisioner/volume"
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -41,6 +45,28 @@ var (
 	printVersion = flag.Bool("version", false, "Print version and exit")
 	qps          = flag.Float64("qps", 0, "Override client qps. If not specified, qps from the provided configuration or defaults are used.")
 	burst        = flag.Int("burst", 0, "Overrid client burst If not specified, burst from the provided configuration or defaults are used.")
+	threadiness  = flag.Int("threadiness", controller.DefaultThreadiness, "Number of claim and volume workers each to launch.")
+	metricsPort  = flag.Int("metrics-port", controller.DefaultMetricsPort, "Port metrics are served on, 0 disables them.")
+
+	identity             = flag.String("identity", "", "Unique identity of this provisioner instance. If not specified, it is loaded from the identity ConfigMap or file, and generated on first start.")
+	identityFile         = flag.String("identity-file", "", "File the identity of this provisioner instance is stored in. Must be on a persistent volume.")
+	identityConfigMap    = flag.String("identity-configmap", "", "ConfigMap (namespace/name) the identity of this provisioner instance is stored in. Takes precedence over identity-file. Defaults to "+vol.DefaultIdentityConfigMap+" in the namespace of the provisioner if no identity file is given.")
+	resourceNameTemplate = flag.String("resource-name-template", vol.DefaultResourceNameTemplate, "Go template LINSTOR resource names are rendered from. May use .PVName, .Namespace, .PVCName and .UID of the claim. PVs keep the name Kubernetes picks.")
+	migrateVolumes       = flag.Bool("migrate-volumes", true, "Annotate PVs created by older versions with their LINSTOR resource on startup.")
+	volumeExpansion      = flag.Bool("volume-expansion", true, "Grow LINSTOR volumes of claims whose storage class allows volume expansion.")
+	volumeSnapshots      = flag.Bool("volume-snapshots", true, "Take LINSTOR snapshots of VolumeSnapshots whose class names this provisioner as snapshotter.")
+	adoptedDeletePolicy  = flag.String("adopted-delete-policy", vol.AdoptedRetain, "What happens to adopted LINSTOR resources when their PV is deleted: retain or delete.")
+	orphanInterval       = flag.Duration("orphan-gc-interval", 10*time.Minute, "Interval between two searches for LINSTOR resources without PV, 0 disables the search.")
+	orphanDelete         = flag.Bool("orphan-gc-delete", false, "Delete LINSTOR resources without PV once they are older than orphan-gc-grace-period.")
+	orphanGracePeriod    = flag.Duration("orphan-gc-grace-period", time.Hour, "Minimum age of LINSTOR resources without PV before they are deleted.")
+	orphanDryRun         = flag.Bool("orphan-gc-dry-run", false, "Only log which LINSTOR resources without PV would be deleted.")
+	clusterID            = flag.String("cluster-id", "", "ID of the Kubernetes cluster recorded on LINSTOR resources. Defaults to the UID of the kube-system namespace.")
+	dryRun               = flag.Bool("dry-run", false, "Only log and report the LINSTOR operations of provisioning and deleting volumes as events. Disables volume expansion, snapshots, unlocking of encrypting clusters and deletion of orphans.")
+	quotaConfigMap       = flag.String("quota-configmap", "", "ConfigMap (namespace/name) with the raw capacity quotas of namespaces without quota annotation.")
+	passphraseSecret     = flag.String("encryption-passphrase-secret", "", "Secret (namespace/name) with the LINSTOR master passphrase in its entry passphrase. Encrypting LINSTOR clusters are unlocked with it.")
+	unlockInterval       = flag.Duration("encryption-unlock-interval", time.Minute, "Interval between two attempts to unlock encrypting LINSTOR clusters.")
+	clusterProfiles      = flag.String("cluster-profiles", "", "ConfigMap and Secret (namespace/name) with the LINSTOR cluster profiles StorageClasses refer to by linstorCluster.")
+	adoptLegacy          = flag.Bool("adopt-legacy-volumes", true, "Treat PVs with the empty identity of older versions as provisioned by this instance. Enable it on one instance only.")
 )
 
 // Version is set via ldflags configued in the Makefile.
@@ -98,13 +124,152 @@ func main() {
 
 	// Create the provisioner: it implements the Provisioner interface expected by
 	// the controller
-	flexProvisioner := vol.NewFlexProvisioner(clientset)
+	id, err := loadIdentity(clientset)
+	if err != nil {
+		glog.Fatalf("Failed to load provisioner identity: %v", err)
+	}
+	glog.Infof("Provisioner identity %s", id)
+
+	cluster := *clusterID
+	if cluster == "" {
+		ns, err := clientset.CoreV1().Namespaces().Get(metav1.NamespaceSystem, metav1.GetOptions{})
+		if err != nil {
+			glog.Fatalf("Failed to determine cluster ID: %v", err)
+		}
+		cluster = string(ns.UID)
+	}
+
+	options := []vol.Option{
+		vol.WithIdentity(id),
+		vol.WithLegacyVolumes(*adoptLegacy),
+		vol.WithResourceNameTemplate(*resourceNameTemplate),
+		vol.WithAdoptedDeletePolicy(*adoptedDeletePolicy),
+		vol.WithClusterID(cluster),
+		vol.WithDryRun(*dryRun),
+		vol.WithVersion(Version),
+	}
+	if *quotaConfigMap != "" {
+		parts := strings.SplitN(*quotaConfigMap, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			glog.Fatalf("Quota ConfigMap %q is not of the form namespace/name", *quotaConfigMap)
+		}
+		options = append(options, vol.WithQuotaConfigMap(parts[0], parts[1]))
+	}
+	if *clusterProfiles != "" {
+		parts := strings.SplitN(*clusterProfiles, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			glog.Fatalf("Cluster profiles %q are not of the form namespace/name", *clusterProfiles)
+		}
+		options = append(options, vol.WithClusterProfiles(parts[0], parts[1]))
+	}
+
+	flexProvisioner, err := vol.NewFlexProvisioner(clientset, options...)
+	if err != nil {
+		glog.Fatalf("Failed to create provisioner: %v", err)
+	}
+
+	if *dryRun {
+		glog.Infof("Dry run, LINSTOR resources are not modified")
+	}
+
+	if *volumeExpansion && !*dryRun {
+		rc, err := vol.NewResizeController(flexProvisioner, *provisioner, controller.DefaultResyncPeriod)
+		if err != nil {
+			glog.Fatalf("Failed to create resize controller: %v", err)
+		}
+		go rc.Run(*threadiness, wait.NeverStop)
+	}
+
+	if *volumeSnapshots && !*dryRun {
+		sc, err := vol.NewSnapshotController(flexProvisioner, *provisioner)
+		if err != nil {
+			glog.Fatalf("Failed to create snapshot controller: %v", err)
+		}
+		go sc.Run(wait.NeverStop)
+	}
+
+	if *passphraseSecret != "" && !*dryRun {
+		parts := strings.SplitN(*passphraseSecret, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			glog.Fatalf("Passphrase Secret %q is not of the form namespace/name", *passphraseSecret)
+		}
+		pu, err := vol.NewPassphraseUnlocker(flexProvisioner, *provisioner, vol.PassphraseUnlockerConfig{
+			Namespace: parts[0],
+			Name:      parts[1],
+			Interval:  *unlockInterval,
+		})
+		if err != nil {
+			glog.Fatalf("Failed to create passphrase unlocker: %v", err)
+		}
+		go pu.Run(wait.NeverStop)
+	}
+
+	if *orphanInterval > 0 {
+		gc, err := vol.NewGarbageCollector(flexProvisioner, *provisioner, vol.GarbageCollectorConfig{
+			Interval:    *orphanInterval,
+			Delete:      *orphanDelete,
+			GracePeriod: *orphanGracePeriod,
+			DryRun:      *orphanDryRun || *dryRun,
+		})
+		if err != nil {
+			glog.Fatalf("Failed to create garbage collector: %v", err)
+		}
+		go gc.Run(wait.NeverStop)
+	}
+
+	if *migrateVolumes {
+		if err := vol.MigrateVolumes(clientset, *provisioner); err != nil {
+			glog.Errorf("Failed to migrate volumes: %v", err)
+		}
+	}
 
 	// Start the provision controller which will dynamically provision Linstor PVs
-	pc := controller.NewProvisionController(clientset, *provisioner, flexProvisioner, serverVersion.GitVersion)
+	pc := controller.NewProvisionController(clientset, *provisioner, flexProvisioner, serverVersion.GitVersion,
+		controller.Threadiness(*threadiness),
+		controller.MetricsPort(int32(*metricsPort)))
 	pc.Run(wait.NeverStop)
 }
 
+// loadIdentity returns the identity given on the command line, or the one
+// persisted in the identity ConfigMap or file. Without either, the default
+// ConfigMap in the namespace of the provisioner is used.
+func loadIdentity(clientset kubernetes.Interface) (types.UID, error) {
+	if *identity != "" {
+		return types.UID(*identity), nil
+	}
+
+	if *identityConfigMap == "" && *identityFile != "" {
+		return vol.LoadIdentityFile(*identityFile)
+	}
+
+	namespace, name := ownNamespace(), vol.DefaultIdentityConfigMap
+	if *identityConfigMap != "" {
+		parts := strings.SplitN(*identityConfigMap, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return "", fmt.Errorf("identity ConfigMap %q is not of the form namespace/name", *identityConfigMap)
+		}
+		namespace, name = parts[0], parts[1]
+	}
+	// Instances with different provisioner names may share the ConfigMap.
+	key := strings.Replace(*provisioner, "/", ".", -1)
+	return vol.LoadIdentityConfigMap(clientset, namespace, name, key)
+}
+
+// ownNamespace returns the namespace the provisioner runs in, taken from the
+// POD_NAMESPACE environment variable or the service account. Outside of a
+// cluster it is kube-system.
+func ownNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	}
+	return metav1.NamespaceSystem
+}
+
 // validateProvisioner tests if provisioner is a valid qualified name.
 // https://github.com/kubernetes/kubernetes/blob/release-1.4/pkg/apis/storage/validation/validation.go
 func validateProvisioner(provisioner string, fldPath *field.Path) field.ErrorList {
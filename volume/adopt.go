@@ -0,0 +1,80 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PVC annotation with the name of an existing LINSTOR resource the claim
+	// is bound to instead of provisioning a new one.
+	annAdoptResource = "linstor.linbit.com/adopt-resource"
+	// PV annotation of volumes whose resource was adopted.
+	annAdopted = "linstor.linbit.com/adopted"
+
+	// Delete policies of adopted volumes.
+	AdoptedRetain = "retain"
+	AdoptedDelete = "delete"
+)
+
+// adoptVolume checks that the existing resource of spec can back claim and
+// returns it. Nothing is created or resized.
+func (p *flexProvisioner) adoptVolume(spec *volumeSpec, claim *v1.PersistentVolumeClaim) (*ResourceInfo, error) {
+	if spec.restoreFrom != nil || spec.cloneFrom != nil {
+		return nil, fmt.Errorf("claims adopting a resource must not have a data source")
+	}
+
+	storage, err := p.newStorage(spec.cluster())
+	if err != nil {
+		return nil, err
+	}
+	info, err := storage.Query(spec.resourceName)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("resource %s to adopt does not exist", spec.resourceName)
+	}
+	if err := p.checkAdoptable(info, claim); err != nil {
+		return nil, err
+	}
+	if len(info.DiskfulNodes()) == 0 {
+		return nil, fmt.Errorf("resource %s to adopt has no diskful replicas", spec.resourceName)
+	}
+	// sizeKiB adds a KiB to every request, a resource of exactly the
+	// requested size is large enough.
+	if info.SizeKiB+1 < spec.requestedSize {
+		return nil, fmt.Errorf("resource %s to adopt is too small: %dKiB, requested %dKiB",
+			spec.resourceName, info.SizeKiB, spec.requestedSize)
+	}
+
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list PVs: %v", err)
+	}
+	for i := range pvs.Items {
+		if name, _ := resourceOf(&pvs.Items[i]); name == spec.resourceName {
+			return nil, fmt.Errorf("resource %s to adopt is already used by PV %s", spec.resourceName, pvs.Items[i].Name)
+		}
+	}
+
+	return info, nil
+}
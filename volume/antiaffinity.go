@@ -0,0 +1,181 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Claim annotation with the anti-affinity group of the claim. The
+	// diskful replicas of claims of the same group in a namespace go to
+	// different nodes.
+	annAntiAffinityGroup = "linstor.linbit.com/anti-affinity-group"
+
+	// Selector label of claims of older versions that asked for
+	// anti-affinity. Claims with it and without the annotation join the
+	// group of the same name.
+	legacyAntiAffinityLabel = "linstorDoNotPlaceWith"
+)
+
+// resolveAntiAffinity keeps the replicas of the volume of claim away from
+// the nodes of its siblings: the claims of its anti-affinity group and, if
+// the StorageClass asks for it, the other claims of its StatefulSet. Only
+// siblings whose volume exists in the same LINSTOR cluster count, so claims
+// provisioned at the same time may still share nodes. In dry-run mode
+// LINSTOR isn't asked for the siblings, they are only recorded by name.
+func (p *flexProvisioner) resolveAntiAffinity(claim *v1.PersistentVolumeClaim, spec *volumeSpec) error {
+	siblings, err := p.siblingClaims(claim, spec.statefulSetAntiAffinity)
+	if err != nil || len(siblings) == 0 {
+		return err
+	}
+	if len(spec.nodeList) != 0 {
+		glog.Warningf("claim %s/%s has anti-affinity, but replicas on nodeList %s are placed regardless",
+			claim.Namespace, claim.Name, strings.Join(spec.nodeList, " "))
+	}
+
+	if p.dryRun {
+		for _, sibling := range siblings {
+			if sibling.Spec.VolumeName != "" {
+				spec.unresolvedSiblings = append(spec.unresolvedSiblings, sibling.Name)
+			}
+		}
+		sort.Strings(spec.unresolvedSiblings)
+		return nil
+	}
+
+	storage, err := p.newStorage(spec.cluster())
+	if err != nil {
+		return err
+	}
+
+	nodes := []string{}
+	for _, sibling := range siblings {
+		if sibling.Spec.VolumeName == "" {
+			continue
+		}
+		pv, err := p.client.CoreV1().PersistentVolumes().Get(sibling.Spec.VolumeName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to get volume of claim %s/%s: %v", sibling.Namespace, sibling.Name, err)
+		}
+		resourceName, controllers := resourceOf(pv)
+		if controllers != spec.cluster() {
+			continue
+		}
+		info, err := storage.Query(resourceName)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			continue
+		}
+		spec.antiAffinity = append(spec.antiAffinity, resourceName)
+		nodes = append(nodes, info.DiskfulNodes()...)
+	}
+	sort.Strings(spec.antiAffinity)
+	spec.avoidNodes = uniq(nodes)
+	sort.Strings(spec.avoidNodes)
+	return nil
+}
+
+// siblingClaims returns the other claims in the anti-affinity group of
+// claim and, with statefulSet, in its StatefulSet.
+func (p *flexProvisioner) siblingClaims(claim *v1.PersistentVolumeClaim, statefulSet bool) ([]v1.PersistentVolumeClaim, error) {
+	group, grouped := antiAffinityGroup(claim)
+	if _, annotated := claim.Annotations[annAntiAffinityGroup]; grouped && !annotated {
+		glog.Warningf("claim %s/%s uses the deprecated selector label %s, it joins anti-affinity group %s instead",
+			claim.Namespace, claim.Name, legacyAntiAffinityLabel, group)
+	}
+	prefix := ""
+	if statefulSet {
+		var err error
+		if prefix, err = p.statefulSetClaimPrefix(claim); err != nil {
+			return nil, err
+		}
+	}
+	if !grouped && prefix == "" {
+		return nil, nil
+	}
+
+	claims, err := p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list claims: %v", err)
+	}
+	siblings := []v1.PersistentVolumeClaim{}
+	for _, c := range claims.Items {
+		if c.UID == claim.UID {
+			continue
+		}
+		g, ok := antiAffinityGroup(&c)
+		inGroup := grouped && ok && g == group
+		if inGroup || (prefix != "" && isOrdinalName(c.Name, prefix)) {
+			siblings = append(siblings, c)
+		}
+	}
+	return siblings, nil
+}
+
+// antiAffinityGroup returns the anti-affinity group of claim, and whether
+// it is in one.
+func antiAffinityGroup(claim *v1.PersistentVolumeClaim) (string, bool) {
+	if group, ok := claim.Annotations[annAntiAffinityGroup]; ok {
+		return group, true
+	}
+	if claim.Spec.Selector != nil && claim.Spec.Selector.MatchLabels[legacyAntiAffinityLabel] == "true" {
+		return legacyAntiAffinityLabel, true
+	}
+	return "", false
+}
+
+// statefulSetClaimPrefix returns the name of the claims of the StatefulSet
+// claim belongs to without their ordinal, "" if it doesn't belong to one.
+// StatefulSets name their claims <template>-<statefulset>-<ordinal>.
+func (p *flexProvisioner) statefulSetClaimPrefix(claim *v1.PersistentVolumeClaim) (string, error) {
+	sets, err := p.client.AppsV1().StatefulSets(claim.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to list StatefulSets: %v", err)
+	}
+	for _, set := range sets.Items {
+		for _, template := range set.Spec.VolumeClaimTemplates {
+			prefix := template.Name + "-" + set.Name + "-"
+			if isOrdinalName(claim.Name, prefix) {
+				return prefix, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// isOrdinalName reports whether name is prefix followed by an ordinal.
+func isOrdinalName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	_, err := strconv.ParseUint(name[len(prefix):], 10, 32)
+	return err == nil
+}
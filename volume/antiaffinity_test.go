@@ -0,0 +1,186 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestIsOrdinalName(t *testing.T) {
+	tests := []struct {
+		name    string
+		ordinal bool
+	}{
+		{name: "data-web-0", ordinal: true},
+		{name: "data-web-1", ordinal: true},
+		{name: "data-web-12", ordinal: true},
+		{name: "data-web-1x"},
+		{name: "data-web-10-a"},
+		{name: "data-web-"},
+		{name: "data-web--1"},
+		{name: "logs-web-1"},
+	}
+
+	for _, test := range tests {
+		if got := isOrdinalName(test.name, "data-web-"); got != test.ordinal {
+			t.Errorf("isOrdinalName(%q) = %v, expected %v", test.name, got, test.ordinal)
+		}
+	}
+}
+
+func TestAntiAffinityGroup(t *testing.T) {
+	legacy := &metav1.LabelSelector{MatchLabels: map[string]string{legacyAntiAffinityLabel: "true"}}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		selector    *metav1.LabelSelector
+		group       string
+		grouped     bool
+	}{
+		{name: "none"},
+		{name: "annotation", annotations: map[string]string{annAntiAffinityGroup: "db"}, group: "db", grouped: true},
+		{name: "legacy label", selector: legacy, group: legacyAntiAffinityLabel, grouped: true},
+		{
+			name:        "annotation takes precedence",
+			annotations: map[string]string{annAntiAffinityGroup: "db"},
+			selector:    legacy,
+			group:       "db",
+			grouped:     true,
+		},
+		{name: "legacy label set to false", selector: &metav1.LabelSelector{MatchLabels: map[string]string{legacyAntiAffinityLabel: "false"}}},
+	}
+
+	for _, test := range tests {
+		claim := &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations},
+			Spec:       v1.PersistentVolumeClaimSpec{Selector: test.selector},
+		}
+		group, grouped := antiAffinityGroup(claim)
+		if group != test.group || grouped != test.grouped {
+			t.Errorf("%s: got %q, %v, expected %q, %v", test.name, group, grouped, test.group, test.grouped)
+		}
+	}
+}
+
+func TestResolveAntiAffinity(t *testing.T) {
+	// sibling is claim ns/<name> of group, bound to PV pv-<name> of
+	// resource <name> in the cluster of controllers.
+	type sibling struct {
+		name  string
+		group string
+		// Joins the group with the legacy selector label instead.
+		legacy      bool
+		controllers string
+		// Node of its replica, the claim is pending if empty.
+		node string
+	}
+	tests := []struct {
+		name     string
+		claim    *v1.PersistentVolumeClaim
+		siblings []sibling
+		// Expected resources and nodes to avoid.
+		antiAffinity []string
+		avoidNodes   []string
+	}{
+		{
+			name: "group",
+			claim: &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "ns",
+				Name:        "new",
+				UID:         "uid-new",
+				Annotations: map[string]string{annAntiAffinityGroup: "db"},
+			}},
+			siblings: []sibling{
+				{name: "a", group: "db", node: "a"},
+				{name: "b", group: "db", node: "b"},
+				{name: "other-group", group: "web", node: "c"},
+				{name: "other-cluster", group: "db", controllers: "other:3370", node: "c"},
+				{name: "pending", group: "db"},
+			},
+			antiAffinity: []string{"a", "b"},
+			avoidNodes:   []string{"a", "b"},
+		},
+		{
+			name: "legacy label",
+			claim: &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "new", UID: "uid-new"},
+				Spec: v1.PersistentVolumeClaimSpec{Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{legacyAntiAffinityLabel: "true"},
+				}},
+			},
+			siblings: []sibling{
+				{name: "a", legacy: true, node: "a"},
+				{name: "b", group: legacyAntiAffinityLabel, node: "b"},
+				{name: "c", group: "db", node: "c"},
+			},
+			antiAffinity: []string{"a", "b"},
+			avoidNodes:   []string{"a", "b"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewFakeStorage("a", "b", "c")
+			client := newFakeClient()
+			client.addClaim(test.claim)
+			for _, s := range test.siblings {
+				claim := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+					Namespace: "ns",
+					Name:      s.name,
+					UID:       types.UID("uid-" + s.name),
+				}}
+				if s.legacy {
+					claim.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{legacyAntiAffinityLabel: "true"}}
+				} else {
+					claim.Annotations = map[string]string{annAntiAffinityGroup: s.group}
+				}
+				client.addClaim(claim)
+				if s.node == "" {
+					continue
+				}
+				claim.Spec.VolumeName = "pv-" + s.name
+				client.pvs[claim.Spec.VolumeName] = &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+					Name:        claim.Spec.VolumeName,
+					Annotations: map[string]string{annResourceName: s.name, annControllers: s.controllers},
+				}}
+				if err := storage.CreateDefinition(s.name, nil); err != nil {
+					t.Fatal(err)
+				}
+				if err := storage.Place(s.name, Placement{Nodes: []string{s.node}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p := newTestProvisioner(t, storage, client)
+
+			spec := &volumeSpec{}
+			if err := p.resolveAntiAffinity(test.claim, spec); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(spec.antiAffinity, test.antiAffinity) {
+				t.Errorf("got anti-affinity %v, expected %v", spec.antiAffinity, test.antiAffinity)
+			}
+			if !reflect.DeepEqual(spec.avoidNodes, test.avoidNodes) {
+				t.Errorf("got nodes to avoid %v, expected %v", spec.avoidNodes, test.avoidNodes)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// checkCapacity fails if the storage pools of spec can't hold its replicas.
+// Every node of the node list needs enough free capacity, and so do as many
+// other allowed nodes as replicas are placed automatically, not counting the
+// nodes of sibling replicas. The free capacity of thin pools is multiplied
+// with the over-subscription ratio. Constraints between replicas aren't taken
+// into account, so a volume may still fail to be placed.
+func checkCapacity(storage Storage, spec *volumeSpec) error {
+	pools, err := storage.StoragePools()
+	if err != nil {
+		return err
+	}
+	if len(pools) == 0 {
+		glog.V(2).Infof("no storage pools reported, not checking capacity of %s", spec.resourceName)
+		return nil
+	}
+
+	placement := spec.placement()
+	poolName := placement.StoragePool
+	if poolName == "" {
+		poolName = defaultStoragePool
+	}
+
+	fits := map[string]bool{}
+	for _, pool := range pools {
+		if pool.Name != poolName || pool.Diskless {
+			continue
+		}
+		free := float64(pool.FreeKiB)
+		if pool.Thin {
+			free *= spec.overSubscription
+		}
+		if free >= float64(spec.requestedSize) {
+			fits[pool.Node] = true
+		}
+	}
+
+	full := []string{}
+	for _, node := range placement.Nodes {
+		if !fits[node] {
+			full = append(full, node)
+		}
+	}
+	if len(full) != 0 {
+		return fmt.Errorf("not enough free capacity for %dKiB in storage pool %s on %s",
+			spec.requestedSize, poolName, strings.Join(full, ", "))
+	}
+
+	if placement.AutoPlace <= uint64(len(placement.Nodes)) {
+		return nil
+	}
+	needed := placement.AutoPlace - uint64(len(placement.Nodes))
+	available := uint64(0)
+	for node := range fits {
+		if contains(placement.Nodes, node) || contains(spec.avoidNodes, node) {
+			continue
+		}
+		if len(placement.AllowedNodes) == 0 || contains(placement.AllowedNodes, node) {
+			available++
+		}
+	}
+	if available < needed {
+		return fmt.Errorf("not enough free capacity for %d replicas of %dKiB in storage pool %s: only %d nodes have room",
+			placement.AutoPlace, spec.requestedSize, poolName, available+uint64(len(placement.Nodes)))
+	}
+	return nil
+}
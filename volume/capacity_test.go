@@ -0,0 +1,137 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckCapacity(t *testing.T) {
+	pools := []StoragePoolInfo{
+		{Name: defaultStoragePool, Node: "a", FreeKiB: 100},
+		{Name: defaultStoragePool, Node: "b", FreeKiB: 50},
+		{Name: defaultStoragePool, Node: "c", FreeKiB: 40, Thin: true},
+		{Name: defaultDisklessStoragePool, Node: "d", Diskless: true},
+		{Name: "ssd", Node: "d", FreeKiB: 1000},
+	}
+
+	tests := []struct {
+		name  string
+		pools []StoragePoolInfo
+		spec  volumeSpec
+		// Substring of the error, empty if the volume must fit.
+		err string
+	}{
+		{
+			name: "no pools reported",
+			spec: volumeSpec{requestedSize: 1 << 40, autoPlace: 3},
+		},
+		{
+			name:  "single replica",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 100},
+		},
+		{
+			name:  "single replica too large",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 101},
+			err:   "not enough free capacity for 1 replicas of 101KiB in storage pool " + defaultStoragePool + ": only 0 nodes have room",
+		},
+		{
+			name:  "autoPlace",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 50, autoPlace: 2},
+		},
+		{
+			name:  "autoPlace without enough nodes",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 50, autoPlace: 3},
+			err:   "only 2 nodes have room",
+		},
+		{
+			name:  "over-subscribed thin pool",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 50, autoPlace: 3, overSubscription: 1.5},
+		},
+		{
+			name:  "nodeList",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 50, nodeList: []string{"a", "b"}},
+		},
+		{
+			name:  "nodeList with a full node",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 60, nodeList: []string{"a", "b", "c"}},
+			err:   "not enough free capacity for 60KiB in storage pool " + defaultStoragePool + " on b, c",
+		},
+		{
+			name:  "storage pool",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 500, storagePool: "ssd"},
+		},
+		{
+			name:  "diskless pools don't count",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 500, storagePool: defaultDisklessStoragePool},
+			err:   "only 0 nodes have room",
+		},
+		{
+			name:  "nodes of siblings don't count",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 50, autoPlace: 2, avoidNodes: []string{"a"}},
+			err:   "only 1 nodes have room",
+		},
+		{
+			name:  "allowed topologies",
+			pools: pools,
+			spec:  volumeSpec{requestedSize: 50, autoPlace: 2, topology: topologyConstraints{nodes: []string{"b", "c"}}},
+			err:   "only 1 nodes have room",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewFakeStorage()
+			storage.Pools = test.pools
+			spec := test.spec
+			if spec.overSubscription == 0 {
+				spec.overSubscription = 1
+			}
+
+			err := checkCapacity(storage, &spec)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCheckCapacityStoragePoolsFail(t *testing.T) {
+	storage := NewFakeStorage()
+	storage.FailOn("StoragePools", errors.New("unreachable"))
+	if err := checkCapacity(storage, &volumeSpec{requestedSize: 1}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
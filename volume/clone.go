@@ -0,0 +1,102 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cloneSource is the resource of a claim a volume is cloned from.
+type cloneSource struct {
+	resource string
+	// Name of the temporary snapshot the clone is restored from.
+	snapshot string
+}
+
+// resolveCloneSource returns the resource of the claim the data source of
+// claim refers to. The source claim must be bound in the same namespace to a
+// PV owned by this provisioner instance.
+func (p *flexProvisioner) resolveCloneSource(claim *v1.PersistentVolumeClaim) (*cloneSource, error) {
+	name := claim.Spec.DataSource.Name
+	source, err := p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get source claim %s: %v", name, err)
+	}
+	if source.Status.Phase != v1.ClaimBound || source.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("source claim %s is not bound", name)
+	}
+
+	pv, err := p.client.CoreV1().PersistentVolumes().Get(source.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get PV %s of source claim %s: %v", source.Spec.VolumeName, name, err)
+	}
+	ref := pv.Spec.ClaimRef
+	if ref == nil || ref.Namespace != claim.Namespace || ref.UID != source.UID {
+		return nil, fmt.Errorf("PV %s is not bound to source claim %s in namespace %s", pv.Name, name, claim.Namespace)
+	}
+	owned, err := p.provisioned(pv)
+	if err != nil {
+		return nil, fmt.Errorf("unable to clone claim %s: %v", name, err)
+	}
+	if !owned {
+		return nil, fmt.Errorf("unable to clone claim %s: this provisioner id %s didn't provision PV %s; id %s did",
+			name, p.identity, pv.Name, pv.Annotations[annProvisionerId])
+	}
+
+	resourceName, _ := resourceOf(pv)
+	return &cloneSource{
+		resource: resourceName,
+		snapshot: "clone-" + string(claim.UID),
+	}, nil
+}
+
+// cloneVolume creates the volume of the defined resource of spec as a copy
+// of its source. Backends that can't clone directly get a temporary snapshot
+// of the source, which is removed whether the clone succeeds or not.
+func cloneVolume(storage Storage, spec *volumeSpec) error {
+	src := spec.cloneFrom
+	info, err := storage.Query(src.resource)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("source resource %s does not exist in the LINSTOR cluster of the storage class", src.resource)
+	}
+	if spec.requestedSize < info.SizeKiB {
+		return fmt.Errorf("requested size %dKiB is smaller than source resource %s (%dKiB)",
+			spec.requestedSize, src.resource, info.SizeKiB)
+	}
+
+	if cloner, ok := storage.(Cloner); ok {
+		return cloner.Clone(spec.resourceName, src.resource)
+	}
+
+	if err := storage.CreateSnapshot(src.resource, src.snapshot); err != nil {
+		return err
+	}
+	defer func() {
+		if err := storage.DeleteSnapshot(src.resource, src.snapshot); err != nil {
+			glog.Errorf("failed to clean up snapshot %s of resource %s: %v", src.snapshot, src.resource, err)
+		}
+	}()
+
+	return restoreVolume(storage, spec, &snapshotSource{resource: src.resource, snapshot: src.snapshot})
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProvisionClone(t *testing.T) {
+	tests := []struct {
+		name string
+		// Size of the source resource.
+		sourceKiB uint64
+		// Storage method that fails.
+		failOn string
+		// Substring of the error, empty if cloning must succeed.
+		err string
+	}{
+		{name: "grown to the request", sourceKiB: 512},
+		{name: "smaller than the source", sourceKiB: 2048, err: "requested size 1025KiB is smaller than source resource src (2048KiB)"},
+		{name: "restore fails", sourceKiB: 512, failOn: "RestoreSnapshot", err: "RestoreSnapshot failed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewFakeStorage("a")
+			if err := storage.CreateDefinition("src", nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.SetSize("src", test.sourceKiB, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.Place("src", Placement{Nodes: []string{"a"}}); err != nil {
+				t.Fatal(err)
+			}
+			if test.failOn != "" {
+				storage.FailOn(test.failOn, errors.New(test.failOn+" failed"))
+			}
+
+			client := newFakeClient()
+			client.addClaim(&v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "src", UID: "uid-src"},
+				Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-src"},
+				Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+			})
+			client.pvs["pv-src"] = &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "pv-src",
+					Annotations: map[string]string{annProvisionerId: "id", annResourceName: "src"},
+				},
+				Spec: v1.PersistentVolumeSpec{
+					ClaimRef: &v1.ObjectReference{Namespace: "ns", Name: "src", UID: "uid-src"},
+				},
+			}
+			p := newTestProvisioner(t, storage, client)
+
+			options := testVolumeOptions(map[string]string{"autoPlace": "1"})
+			options.PVC.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "src"}
+			_, err := p.Provision(options)
+
+			// The temporary snapshot never outlives the clone.
+			if snap, _ := storage.QuerySnapshot("src", "clone-uid-1"); snap != nil {
+				t.Errorf("temporary snapshot %s was left behind", snap.Name)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				if info, _ := storage.Query("pvc-1"); info != nil {
+					t.Errorf("resource pvc-1 was left behind")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			info, _ := storage.Query("pvc-1")
+			if info == nil {
+				t.Fatalf("resource pvc-1 was not created")
+			}
+			if info.SizeKiB != 1025 {
+				t.Errorf("clone has %dKiB, expected 1025KiB", info.SizeKiB)
+			}
+		})
+	}
+}
+
+func TestResolveCloneSource(t *testing.T) {
+	tests := []struct {
+		name string
+		// Changes to the source claim and its PV.
+		setup func(claim *v1.PersistentVolumeClaim, pv *v1.PersistentVolume)
+		err   string
+	}{
+		{name: "bound"},
+		{
+			name:  "pending",
+			setup: func(claim *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) { claim.Status.Phase = v1.ClaimPending },
+			err:   "source claim src is not bound",
+		},
+		{
+			name:  "PV bound to another claim",
+			setup: func(claim *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) { pv.Spec.ClaimRef.UID = "uid-other" },
+			err:   "PV pv-src is not bound to source claim src in namespace ns",
+		},
+		{
+			name: "other provisioner instance",
+			setup: func(claim *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) {
+				pv.Annotations[annProvisionerId] = "other"
+			},
+			err: "this provisioner id id didn't provision PV pv-src; id other did",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeClient()
+			claim := &v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "src", UID: "uid-src"},
+				Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-src"},
+				Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+			}
+			pv := &v1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "pv-src",
+					Annotations: map[string]string{annProvisionerId: "id", annResourceName: "src"},
+				},
+				Spec: v1.PersistentVolumeSpec{
+					ClaimRef: &v1.ObjectReference{Namespace: "ns", Name: "src", UID: "uid-src"},
+				},
+			}
+			if test.setup != nil {
+				test.setup(claim, pv)
+			}
+			client.addClaim(claim)
+			client.pvs[pv.Name] = pv
+			p := newTestProvisioner(t, NewFakeStorage(), client)
+
+			options := testVolumeOptions(nil)
+			options.PVC.Spec.DataSource = &v1.TypedLocalObjectReference{Kind: "PersistentVolumeClaim", Name: "src"}
+			source, err := p.resolveCloneSource(options.PVC)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if source.resource != "src" || source.snapshot != "clone-uid-1" {
+				t.Errorf("got source %+v", source)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// PV annotation with the cluster profile of the volume. PVs with a
+	// profile don't record their controllers, so changing the profile
+	// applies to all of them.
+	annLinstorCluster = "linstor.linbit.com/cluster"
+
+	// Prefix that turns a profile name into the controllers string
+	// StorageProviders are called with.
+	clusterProfileRefPrefix = "profile:"
+)
+
+// clusterProfiles reads named LINSTOR cluster profiles from a ConfigMap and
+// a Secret of the same name. The entries of profile <name> are:
+//
+//	ConfigMap <name>.controllers          controllers, as in StorageClasses
+//	ConfigMap <name>.server-name          name to verify the certificate for
+//	ConfigMap <name>.insecure-skip-verify don't verify the certificate
+//	Secret    <name>.ca.crt               CA of the controller certificates
+//	Secret    <name>.tls.crt, .tls.key    client certificate
+//
+// Profiles are read on every use, so changes apply right away. Profiles with
+// TLS settings keep their transport, and its connections, until the settings
+// change.
+type clusterProfiles struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+
+	mu sync.Mutex
+	// Transports of the profiles with TLS settings, by profile name.
+	transports map[string]*profileTransport
+}
+
+// clusterProfile is a LINSTOR cluster as described by a profile.
+type clusterProfile struct {
+	controllers string
+	tlsConfig   *tls.Config
+	// Hash of the entries tlsConfig was built from.
+	tlsHash string
+}
+
+// profileTransport is the transport of a profile built from the TLS settings
+// with hash tlsHash.
+type profileTransport struct {
+	tlsHash   string
+	transport *http.Transport
+}
+
+// clusterProfileRef returns the controllers string of the profile name.
+func clusterProfileRef(name string) string {
+	return clusterProfileRefPrefix + name
+}
+
+// parseClusterProfileRef returns the profile name of a controllers string,
+// and whether it refers to a profile at all.
+func parseClusterProfileRef(controllers string) (string, bool) {
+	if !strings.HasPrefix(controllers, clusterProfileRefPrefix) {
+		return "", false
+	}
+	return controllers[len(clusterProfileRefPrefix):], true
+}
+
+// provider returns a StorageProvider that resolves profile references and
+// passes everything else on to fallback.
+func (c *clusterProfiles) provider(fallback StorageProvider) StorageProvider {
+	return func(controllers string) (Storage, error) {
+		name, ok := parseClusterProfileRef(controllers)
+		if !ok {
+			return fallback(controllers)
+		}
+		profile, err := c.get(name)
+		if err != nil {
+			return nil, err
+		}
+		client, err := newLinstorClientTransport(profile.controllers, c.transport(name, profile))
+		if err != nil {
+			return nil, fmt.Errorf("LINSTOR cluster profile %s: %v", name, err)
+		}
+		return &linstorStorage{client: client}, nil
+	}
+}
+
+// transport returns the transport of the profile name, nil if it has no TLS
+// settings. The transport of settings that changed is replaced, and its idle
+// connections are closed.
+func (c *clusterProfiles) transport(name string, profile *clusterProfile) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.transports[name]
+	if ok && profile.tlsConfig != nil && cached.tlsHash == profile.tlsHash {
+		return cached.transport
+	}
+	if ok {
+		cached.transport.CloseIdleConnections()
+		delete(c.transports, name)
+	}
+	if profile.tlsConfig == nil {
+		return nil
+	}
+
+	if c.transports == nil {
+		c.transports = map[string]*profileTransport{}
+	}
+	transport := newLinstorTransport(profile.tlsConfig)
+	c.transports[name] = &profileTransport{tlsHash: profile.tlsHash, transport: transport}
+	return transport
+}
+
+// get reads the profile name.
+func (c *clusterProfiles) get(name string) (*clusterProfile, error) {
+	if c == nil {
+		return nil, fmt.Errorf("LINSTOR cluster profile %s requested, but no cluster profiles are configured", name)
+	}
+
+	cm, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(c.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get cluster profile ConfigMap %s/%s: %v", c.namespace, c.name, err)
+	}
+	controllers, ok := cm.Data[name+".controllers"]
+	if !ok {
+		return nil, fmt.Errorf("LINSTOR cluster profile %s does not exist in ConfigMap %s/%s", name, c.namespace, c.name)
+	}
+
+	profile := &clusterProfile{controllers: controllers}
+	config := &tls.Config{ServerName: cm.Data[name+".server-name"]}
+	tlsSettings := config.ServerName != ""
+	if v, ok := cm.Data[name+".insecure-skip-verify"]; ok {
+		if config.InsecureSkipVerify, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("LINSTOR cluster profile %s: insecure-skip-verify %q is not a boolean", name, v)
+		}
+		tlsSettings = true
+	}
+
+	// The Secret is optional, profiles may not need any credentials.
+	secret, err := c.client.CoreV1().Secrets(c.namespace).Get(c.name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("unable to get cluster profile Secret %s/%s: %v", c.namespace, c.name, err)
+	}
+	var secretData map[string][]byte
+	if err == nil {
+		secretData = secret.Data
+		if ca, ok := secret.Data[name+".ca.crt"]; ok {
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("LINSTOR cluster profile %s: no certificates in ca.crt", name)
+			}
+			tlsSettings = true
+		}
+		cert, hasCert := secret.Data[name+".tls.crt"]
+		key, hasKey := secret.Data[name+".tls.key"]
+		if hasCert != hasKey {
+			return nil, fmt.Errorf("LINSTOR cluster profile %s: tls.crt and tls.key must be given together", name)
+		}
+		if hasCert {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("LINSTOR cluster profile %s: invalid client certificate: %v", name, err)
+			}
+			config.Certificates = []tls.Certificate{pair}
+			tlsSettings = true
+		}
+	}
+
+	if tlsSettings {
+		profile.tlsConfig = config
+		profile.tlsHash = hashEntries(
+			[]byte(cm.Data[name+".server-name"]),
+			[]byte(cm.Data[name+".insecure-skip-verify"]),
+			secretData[name+".ca.crt"],
+			secretData[name+".tls.crt"],
+			secretData[name+".tls.key"],
+		)
+	}
+	return profile, nil
+}
+
+// hashEntries returns a hash of entries that changes if any of them does.
+func hashEntries(entries ...[]byte) string {
+	h := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%d:", len(entry))
+		h.Write(entry)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// classCluster returns the controllers string of the LINSTOR cluster of a
+// StorageClass with params.
+func classCluster(params map[string]string) string {
+	if name := lookupParameter(params, "linstorCluster"); name != "" {
+		return clusterProfileRef(name)
+	}
+	return lookupParameter(params, "controllers")
+}
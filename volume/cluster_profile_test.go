@@ -0,0 +1,69 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestClusterProfileTransport(t *testing.T) {
+	client := newFakeClient()
+	cm := &v1.ConfigMap{Data: map[string]string{
+		"a.controllers": "ctrl-a",
+		"a.server-name": "linstor-a",
+	}}
+	client.configMaps["kube-system/profiles"] = cm
+	profiles := &clusterProfiles{client: client, namespace: "kube-system", name: "profiles"}
+
+	newClient := func() *linstorClient {
+		storage, err := profiles.provider(nil)(clusterProfileRef("a"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return storage.(*linstorStorage).client
+	}
+
+	first := newClient()
+	if first.httpClient.Transport == nil || first.endpoints[0].Scheme != "https" {
+		t.Fatalf("profile with TLS settings got transport %v and endpoint %s", first.httpClient.Transport, first.endpoints[0])
+	}
+	if again := newClient(); again.httpClient.Transport != first.httpClient.Transport {
+		t.Errorf("the transport of an unchanged profile was rebuilt")
+	}
+
+	client.secrets["kube-system/profiles"] = &v1.Secret{Data: map[string][]byte{"a.ca.crt": []byte("x")}}
+	if _, err := profiles.provider(nil)(clusterProfileRef("a")); err == nil {
+		t.Errorf("expected an invalid CA to be rejected")
+	}
+	delete(client.secrets, "kube-system/profiles")
+
+	cm.Data["a.server-name"] = "linstor-a.example.com"
+	changed := newClient()
+	if changed.httpClient.Transport == first.httpClient.Transport {
+		t.Errorf("the transport was kept after the TLS settings changed")
+	}
+
+	delete(cm.Data, "a.server-name")
+	if plain := newClient(); plain.httpClient.Transport != nil || plain.endpoints[0].Scheme != "http" {
+		t.Errorf("profile without TLS settings got transport %v and endpoint %s", plain.httpClient.Transport, plain.endpoints[0])
+	}
+	if len(profiles.transports) != 0 {
+		t.Errorf("transports of profiles without TLS settings are kept: %v", profiles.transports)
+	}
+}
@@ -19,17 +19,17 @@ package volume
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	linstor "github.com/LINBIT/golinstor"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
 )
 
 func (p *flexProvisioner) Delete(volume *v1.PersistentVolume) error {
-	glog.Infof("Delete called for volume:", volume.Name)
+	glog.Infof("Delete called for volume: %s", volume.Name)
 
 	provisioned, err := p.provisioned(volume)
 	if err != nil {
@@ -37,17 +37,74 @@ func (p *flexProvisioner) Delete(volume *v1.PersistentVolume) error {
 	}
 	if !provisioned {
 		strerr := fmt.Sprintf("this provisioner id %s didn't provision volume %q and so can't delete it; id %s did & can", p.identity, volume.Name, volume.Annotations[annProvisionerId])
-		return &controller.IgnoredError{strerr}
+		return &controller.IgnoredError{Reason: strerr}
 	}
 
-	r := linstor.NewResourceDeployment(
-		linstor.ResourceDeploymentConfig{
-			Name:        fmt.Sprintf("%s-%s", volume.Spec.ClaimRef.Namespace, volume.Spec.ClaimRef.Name),
-			Controllers: volume.Spec.FlexVolume.Options["controllers"],
-			LogOut:      os.Stderr,
-		})
+	resourceName, controllers := resourceOf(volume)
+	if volume.Annotations[annAdopted] == "true" {
+		if p.adoptedDeletePolicy != AdoptedDelete {
+			glog.Infof("volume %q was adopted from resource %s, retaining the resource", volume.Name, resourceName)
+			return nil
+		}
+		// The ProvisionController deletes volumes whose PV it failed to
+		// save. The user's data must survive that.
+		_, err := p.client.CoreV1().PersistentVolumes().Get(volume.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			glog.Infof("volume %q adopted from resource %s was never saved, retaining the resource", volume.Name, resourceName)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to get volume %q: %v", volume.Name, err)
+		}
+	}
+
+	if p.dryRun {
+		return p.reportPlan(volume, eventDeletionPlanned, fmt.Sprintf("delete resource %s (via %s)", resourceName, describeCluster(controllers)))
+	}
+
+	storage, err := p.newStorage(controllers)
+	if err != nil {
+		return err
+	}
 
-	return r.Delete()
+	info, err := p.locateResource(storage, volume)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		glog.Infof("resource %s of volume %q does not exist, nothing to delete", resourceName, volume.Name)
+		return p.deleteVolumeKey(volume)
+	}
+	if err := p.checkOwner(info, volume); err != nil {
+		return fmt.Errorf("refusing to delete volume %q: %v", volume.Name, err)
+	}
+
+	if err := storage.Delete(info.Name); err != nil {
+		return err
+	}
+	return p.deleteVolumeKey(volume)
+}
+
+// resourceOf returns the LINSTOR resource name and controllers of a PV. PVs
+// of older versions don't have the annotations, their resource is named
+// like the PV and the controllers are taken from the FlexVolume options. PVs
+// with a cluster profile refer to it instead of their controllers.
+func resourceOf(volume *v1.PersistentVolume) (string, string) {
+	resourceName, ok := volume.Annotations[annResourceName]
+	if !ok {
+		resourceName = volume.Name
+	}
+
+	if cluster, ok := volume.Annotations[annLinstorCluster]; ok {
+		return resourceName, clusterProfileRef(cluster)
+	}
+
+	controllers, ok := volume.Annotations[annControllers]
+	if !ok && volume.Spec.FlexVolume != nil {
+		controllers = volume.Spec.FlexVolume.Options["controllers"]
+	}
+
+	return resourceName, controllers
 }
 
 func (p *flexProvisioner) provisioned(volume *v1.PersistentVolume) (bool, error) {
@@ -56,5 +113,14 @@ func (p *flexProvisioner) provisioned(volume *v1.PersistentVolume) (bool, error)
 		return false, fmt.Errorf("PV doesn't have an annotation %s", annProvisionerId)
 	}
 
+	// Versions before persistent identities annotated every PV with an
+	// empty identity.
+	if provisionerId == "" {
+		if p.adoptLegacy {
+			glog.Infof("volume %q carries the legacy empty provisioner id, treating it as provisioned by %s", volume.Name, p.identity)
+		}
+		return p.adoptLegacy, nil
+	}
+
 	return provisionerId == string(p.identity), nil
 }
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Claim annotation with the Secret in the namespace of the claim that
+	// holds the key of its volume. On PVs it records namespace/name of the
+	// Secret.
+	annEncryptionKeySecret = "linstor.linbit.com/encryption-key-secret"
+
+	// Entry of Secrets with the key of a volume.
+	volumeKeyEntry = "passphrase"
+	// Size of generated volume keys in bytes.
+	volumeKeySize = 32
+)
+
+// resolveVolumeKey looks up the key of the volume of claim if spec asks for
+// one of its own. It is read from the Secret named by the claim annotation,
+// or else generated and stored in a new Secret next to the claim.
+func (p *flexProvisioner) resolveVolumeKey(claim *v1.PersistentVolumeClaim, spec *volumeSpec) error {
+	if !spec.volumeKeys {
+		return nil
+	}
+	// Their volume is created from the source, and so is its key.
+	if spec.restoreFrom != nil || spec.cloneFrom != nil {
+		return fmt.Errorf("perVolumeKeys is not supported for restored or cloned volumes")
+	}
+
+	name, given := claim.Annotations[annEncryptionKeySecret]
+	if !given {
+		name = spec.resourceName + "-encryption-key"
+	}
+
+	secrets := p.client.CoreV1().Secrets(claim.Namespace)
+	secret, err := secrets.Get(name, metav1.GetOptions{})
+	switch {
+	case err == nil:
+		// A generated Secret is reused if creating the volume is retried.
+		if !given && !p.ownsVolumeKey(secret, spec.resourceName) {
+			return fmt.Errorf("Secret %s/%s exists and does not hold the key of resource %s", claim.Namespace, name, spec.resourceName)
+		}
+	case apierrors.IsNotFound(err) && !given:
+		if secret, err = p.createVolumeKey(claim.Namespace, name, spec.resourceName); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unable to get encryption key Secret %s/%s: %v", claim.Namespace, name, err)
+	}
+
+	key := string(secret.Data[volumeKeyEntry])
+	if key == "" {
+		return fmt.Errorf("Secret %s/%s has no entry %s", claim.Namespace, name, volumeKeyEntry)
+	}
+	spec.volumeKey = key
+	spec.volumeKeySecret = claim.Namespace + "/" + name
+	return nil
+}
+
+// createVolumeKey generates a key for resourceName and stores it in the
+// Secret namespace/name.
+func (p *flexProvisioner) createVolumeKey(namespace, name, resourceName string) (*v1.Secret, error) {
+	key := make([]byte, volumeKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("unable to generate encryption key: %v", err)
+	}
+
+	secret, err := p.client.CoreV1().Secrets(namespace).Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				annProvisionerId: string(p.identity),
+				annResourceName:  resourceName,
+			},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			volumeKeyEntry: []byte(base64.StdEncoding.EncodeToString(key)),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create encryption key Secret %s/%s: %v", namespace, name, err)
+	}
+	glog.Infof("generated encryption key of resource %s in Secret %s/%s", resourceName, namespace, name)
+	return secret, nil
+}
+
+// ownsVolumeKey reports whether secret was generated by this provisioner
+// for resourceName.
+func (p *flexProvisioner) ownsVolumeKey(secret *v1.Secret, resourceName string) bool {
+	return secret.Annotations[annProvisionerId] == string(p.identity) &&
+		secret.Annotations[annResourceName] == resourceName
+}
+
+// deleteVolumeKey removes the key Secret of volume once its resource is
+// gone, if the provisioner generated it. Secrets given by the user are kept.
+func (p *flexProvisioner) deleteVolumeKey(volume *v1.PersistentVolume) error {
+	ref, ok := volume.Annotations[annEncryptionKeySecret]
+	if !ok {
+		return nil
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid encryption key Secret %q on volume %q", ref, volume.Name)
+	}
+
+	secrets := p.client.CoreV1().Secrets(parts[0])
+	secret, err := secrets.Get(parts[1], metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get encryption key Secret %s: %v", ref, err)
+	}
+	resourceName, _ := resourceOf(volume)
+	if !p.ownsVolumeKey(secret, resourceName) {
+		return nil
+	}
+	if err := secrets.Delete(parts[1], &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete encryption key Secret %s: %v", ref, err)
+	}
+	return nil
+}
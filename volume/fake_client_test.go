@@ -0,0 +1,267 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	storagev1client "k8s.io/client-go/kubernetes/typed/storage/v1"
+	"k8s.io/client-go/rest"
+)
+
+// fakeClient is a Kubernetes client that only serves the namespaces,
+// ConfigMaps, Secrets, claims, PVs and StorageClasses the provisioner uses. Anything else panics, which
+// shows up as a test failure.
+type fakeClient struct {
+	kubernetes.Interface
+
+	namespaces map[string]*v1.Namespace
+	configMaps map[string]*v1.ConfigMap
+	// Keyed by namespace/name like configMaps.
+	secrets map[string]*v1.Secret
+	claims  map[string]*v1.PersistentVolumeClaim
+	pvs     map[string]*v1.PersistentVolume
+	classes map[string]*storagev1.StorageClass
+	// Client of the objects without a typed client, see serveObjects.
+	rest rest.Interface
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		namespaces: map[string]*v1.Namespace{},
+		configMaps: map[string]*v1.ConfigMap{},
+		secrets:    map[string]*v1.Secret{},
+		claims:     map[string]*v1.PersistentVolumeClaim{},
+		pvs:        map[string]*v1.PersistentVolume{},
+		classes:    map[string]*storagev1.StorageClass{},
+	}
+}
+
+// addClaim adds claim, keyed by namespace/name.
+func (c *fakeClient) addClaim(claim *v1.PersistentVolumeClaim) {
+	c.claims[claim.Namespace+"/"+claim.Name] = claim
+}
+
+// addNamespace adds the namespace name with annotations.
+func (c *fakeClient) addNamespace(name string, annotations map[string]string) {
+	c.namespaces[name] = &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}}
+}
+
+// serveObjects serves objects, keyed by their API path, through the REST
+// client of c until the returned function is called. Other paths aren't
+// found.
+func (c *fakeClient) serveObjects(t *testing.T, objects map[string]interface{}) func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		obj, ok := objects[r.URL.Path]
+		if !ok || r.Method != "GET" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(obj)
+	}))
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.rest, err = rest.NewRESTClient(u, "", rest.ContentConfig{NegotiatedSerializer: scheme.Codecs}, 0, 0, nil, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server.Close
+}
+
+func (c *fakeClient) CoreV1() corev1.CoreV1Interface {
+	return fakeCoreV1{c: c}
+}
+
+type fakeCoreV1 struct {
+	corev1.CoreV1Interface
+	c *fakeClient
+}
+
+func (f fakeCoreV1) RESTClient() rest.Interface {
+	return f.c.rest
+}
+
+func (f fakeCoreV1) Namespaces() corev1.NamespaceInterface {
+	return fakeNamespaces{c: f.c}
+}
+
+func (f fakeCoreV1) ConfigMaps(namespace string) corev1.ConfigMapInterface {
+	return fakeConfigMaps{c: f.c, namespace: namespace}
+}
+
+func (f fakeCoreV1) Secrets(namespace string) corev1.SecretInterface {
+	return fakeSecrets{c: f.c, namespace: namespace}
+}
+
+func (f fakeCoreV1) PersistentVolumeClaims(namespace string) corev1.PersistentVolumeClaimInterface {
+	return fakeClaims{c: f.c, namespace: namespace}
+}
+
+func (f fakeCoreV1) PersistentVolumes() corev1.PersistentVolumeInterface {
+	return fakePersistentVolumes{c: f.c}
+}
+
+type fakeNamespaces struct {
+	corev1.NamespaceInterface
+	c *fakeClient
+}
+
+func (f fakeNamespaces) Get(name string, _ metav1.GetOptions) (*v1.Namespace, error) {
+	ns, ok := f.c.namespaces[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("namespaces"), name)
+	}
+	return ns.DeepCopy(), nil
+}
+
+type fakeConfigMaps struct {
+	corev1.ConfigMapInterface
+	c         *fakeClient
+	namespace string
+}
+
+func (f fakeConfigMaps) Get(name string, _ metav1.GetOptions) (*v1.ConfigMap, error) {
+	cm, ok := f.c.configMaps[f.namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("configmaps"), name)
+	}
+	return cm.DeepCopy(), nil
+}
+
+type fakeSecrets struct {
+	corev1.SecretInterface
+	c         *fakeClient
+	namespace string
+}
+
+func (f fakeSecrets) Get(name string, _ metav1.GetOptions) (*v1.Secret, error) {
+	secret, ok := f.c.secrets[f.namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("secrets"), name)
+	}
+	return secret.DeepCopy(), nil
+}
+
+type fakeClaims struct {
+	corev1.PersistentVolumeClaimInterface
+	c         *fakeClient
+	namespace string
+}
+
+func (f fakeClaims) Get(name string, _ metav1.GetOptions) (*v1.PersistentVolumeClaim, error) {
+	claim, ok := f.c.claims[f.namespace+"/"+name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("persistentvolumeclaims"), name)
+	}
+	return claim.DeepCopy(), nil
+}
+
+func (f fakeClaims) List(_ metav1.ListOptions) (*v1.PersistentVolumeClaimList, error) {
+	list := &v1.PersistentVolumeClaimList{}
+	for _, claim := range f.c.claims {
+		if f.namespace == "" || claim.Namespace == f.namespace {
+			list.Items = append(list.Items, *claim.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (f fakeClaims) UpdateStatus(claim *v1.PersistentVolumeClaim) (*v1.PersistentVolumeClaim, error) {
+	key := f.namespace + "/" + claim.Name
+	if _, ok := f.c.claims[key]; !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("persistentvolumeclaims"), claim.Name)
+	}
+	f.c.claims[key] = claim.DeepCopy()
+	return claim.DeepCopy(), nil
+}
+
+type fakePersistentVolumes struct {
+	corev1.PersistentVolumeInterface
+	c *fakeClient
+}
+
+func (f fakePersistentVolumes) Get(name string, _ metav1.GetOptions) (*v1.PersistentVolume, error) {
+	pv, ok := f.c.pvs[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("persistentvolumes"), name)
+	}
+	return pv.DeepCopy(), nil
+}
+
+func (f fakePersistentVolumes) List(_ metav1.ListOptions) (*v1.PersistentVolumeList, error) {
+	list := &v1.PersistentVolumeList{}
+	for _, pv := range f.c.pvs {
+		list.Items = append(list.Items, *pv.DeepCopy())
+	}
+	return list, nil
+}
+
+func (f fakePersistentVolumes) Update(pv *v1.PersistentVolume) (*v1.PersistentVolume, error) {
+	if _, ok := f.c.pvs[pv.Name]; !ok {
+		return nil, apierrors.NewNotFound(v1.Resource("persistentvolumes"), pv.Name)
+	}
+	f.c.pvs[pv.Name] = pv.DeepCopy()
+	return pv.DeepCopy(), nil
+}
+
+func (c *fakeClient) StorageV1() storagev1client.StorageV1Interface {
+	return fakeStorageV1{c: c}
+}
+
+type fakeStorageV1 struct {
+	storagev1client.StorageV1Interface
+	c *fakeClient
+}
+
+func (f fakeStorageV1) StorageClasses() storagev1client.StorageClassInterface {
+	return fakeStorageClasses{c: f.c}
+}
+
+type fakeStorageClasses struct {
+	storagev1client.StorageClassInterface
+	c *fakeClient
+}
+
+func (f fakeStorageClasses) Get(name string, _ metav1.GetOptions) (*storagev1.StorageClass, error) {
+	class, ok := f.c.classes[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(storagev1.Resource("storageclasses"), name)
+	}
+	return class.DeepCopy(), nil
+}
+
+func (f fakeStorageClasses) List(_ metav1.ListOptions) (*storagev1.StorageClassList, error) {
+	list := &storagev1.StorageClassList{}
+	for _, class := range f.c.classes {
+		list.Items = append(list.Items, *class.DeepCopy())
+	}
+	return list, nil
+}
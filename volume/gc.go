@@ -0,0 +1,238 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// Events recorded on the missing PVs of orphaned resources.
+	eventOrphanedResource        = "OrphanedResource"
+	eventOrphanedResourceDeleted = "OrphanedResourceDeleted"
+)
+
+var (
+	orphanedResources = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "linstor",
+		Subsystem: "provisioner",
+		Name:      "orphaned_resources",
+		Help:      "Number of LINSTOR resources of this provisioner instance without a PV.",
+	})
+	orphanedResourcesDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "linstor",
+		Subsystem: "provisioner",
+		Name:      "orphaned_resources_deleted_total",
+		Help:      "Total number of orphaned LINSTOR resources deleted.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(orphanedResources, orphanedResourcesDeleted)
+}
+
+// GarbageCollectorConfig configures a GarbageCollector.
+type GarbageCollectorConfig struct {
+	// Interval between two collections.
+	Interval time.Duration
+	// Delete orphans older than GracePeriod. Orphans are only reported
+	// otherwise.
+	Delete      bool
+	GracePeriod time.Duration
+	// Log deletions instead of carrying them out.
+	DryRun bool
+}
+
+// GarbageCollector finds LINSTOR resources that this provisioner instance
+// created but that have no PV, because provisioning was interrupted or the
+// PV was deleted by hand. Only resources tagged with the identity of the
+// provisioner and cluster are considered, in the LINSTOR clusters of its
+// StorageClasses and PVs. Resources whose PV exists under another name or
+// whose claim is still pending are left alone.
+type GarbageCollector struct {
+	provisioner     *flexProvisioner
+	provisionerName string
+	config          GarbageCollectorConfig
+	recorder        record.EventRecorder
+
+	// When orphans were first seen. Orphans are reported once and their age
+	// is taken from it if they lack a creation time.
+	firstSeen map[string]time.Time
+}
+
+// NewGarbageCollector creates a GarbageCollector for provisionerName. It
+// shares provisioner, which must have been created by NewFlexProvisioner.
+func NewGarbageCollector(provisioner controller.Provisioner, provisionerName string, config GarbageCollectorConfig) (*GarbageCollector, error) {
+	p, err := sharedProvisioner(provisioner)
+	if err != nil {
+		return nil, err
+	}
+	client := p.client
+
+	return &GarbageCollector{
+		provisioner:     p,
+		provisionerName: provisionerName,
+		config:          config,
+		recorder:        newEventRecorder(client, "linstor-garbage-collector"),
+		firstSeen:       map[string]time.Time{},
+	}, nil
+}
+
+// Run collects orphans every Interval until stopCh is closed.
+func (c *GarbageCollector) Run(stopCh <-chan struct{}) {
+	glog.Infof("Starting orphaned resource collector")
+	wait.Until(func() {
+		if err := c.collect(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error collecting orphaned resources: %v", err))
+		}
+	}, c.config.Interval, stopCh)
+}
+
+func (c *GarbageCollector) collect() error {
+	client := c.provisioner.client
+
+	// Resources are looked up by name in every cluster, an orphan must not
+	// be in use by any PV.
+	used := map[string]bool{}
+	volumes := map[string]bool{}
+	clusters := map[string]bool{}
+	pvs, err := client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list PVs: %v", err)
+	}
+	for i := range pvs.Items {
+		name, controllers := resourceOf(&pvs.Items[i])
+		used[name] = true
+		volumes[pvs.Items[i].Name] = true
+		if pvs.Items[i].Annotations[annProvisionedBy] == c.provisionerName {
+			clusters[controllers] = true
+		}
+	}
+
+	// Claims that are still pending may be provisioned right now.
+	pending := map[string]bool{}
+	claims, err := client.CoreV1().PersistentVolumeClaims(v1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list claims: %v", err)
+	}
+	for _, claim := range claims.Items {
+		if claim.Status.Phase == v1.ClaimPending {
+			pending[string(claim.UID)] = true
+		}
+	}
+
+	classes, err := client.StorageV1().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list StorageClasses: %v", err)
+	}
+	for _, class := range classes.Items {
+		if class.Provisioner == c.provisionerName {
+			clusters[classCluster(class.Parameters)] = true
+		}
+	}
+
+	controllers := make([]string, 0, len(clusters))
+	for cluster := range clusters {
+		controllers = append(controllers, cluster)
+	}
+	sort.Strings(controllers)
+
+	orphans := map[string]bool{}
+	remaining := 0
+	for _, cluster := range controllers {
+		storage, err := c.provisioner.newStorage(cluster)
+		if err != nil {
+			return err
+		}
+		resources, err := storage.List()
+		if err != nil {
+			return err
+		}
+		for i := range resources {
+			info := &resources[i]
+			if !c.provisioner.ownsResource(info) || used[info.Name] || orphans[info.Name] {
+				continue
+			}
+			if volumes[info.Props[propPVName]] || pending[info.Props[propPVCUID]] {
+				continue
+			}
+			orphans[info.Name] = true
+			if !c.collectOrphan(storage, info) {
+				remaining++
+			}
+		}
+	}
+
+	for name := range c.firstSeen {
+		if !orphans[name] {
+			delete(c.firstSeen, name)
+		}
+	}
+	orphanedResources.Set(float64(remaining))
+	return nil
+}
+
+// collectOrphan reports an orphaned resource when it is first seen and
+// deletes it once it is older than the grace period, if configured to. It
+// reports whether the resource was deleted.
+func (c *GarbageCollector) collectOrphan(storage Storage, info *ResourceInfo) bool {
+	ref := &v1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: info.Props[propPVName]}
+	if ref.Name == "" {
+		ref.Name = info.Name
+	}
+
+	firstSeen, ok := c.firstSeen[info.Name]
+	if !ok {
+		firstSeen = time.Now()
+		c.firstSeen[info.Name] = firstSeen
+		glog.Warningf("LINSTOR resource %s has no PV", info.Name)
+		c.recorder.Eventf(ref, v1.EventTypeWarning, eventOrphanedResource, "LINSTOR resource %s has no PV", info.Name)
+	}
+
+	created, err := time.Parse(time.RFC3339, info.Props[propCreatedAt])
+	if err != nil {
+		created = firstSeen
+	}
+	if !c.config.Delete || time.Since(created) < c.config.GracePeriod {
+		return false
+	}
+
+	if c.config.DryRun {
+		glog.Infof("dry run: would delete orphaned resource %s", info.Name)
+		return false
+	}
+	if err := storage.Delete(info.Name); err != nil {
+		utilruntime.HandleError(fmt.Errorf("unable to delete orphaned resource %s: %v", info.Name, err))
+		return false
+	}
+	delete(c.firstSeen, info.Name)
+	orphanedResourcesDeleted.Inc()
+	glog.Infof("Deleted orphaned resource %s", info.Name)
+	c.recorder.Eventf(ref, v1.EventTypeNormal, eventOrphanedResourceDeleted, "deleted orphaned LINSTOR resource %s", info.Name)
+	return true
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestGarbageCollect(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	owned := func(pvName, uid, created string) map[string]string {
+		props := map[string]string{
+			propClusterID:     "c1",
+			propProvisionerId: "id",
+			propPVName:        pvName,
+			propPVCUID:        uid,
+		}
+		if created != "" {
+			props[propCreatedAt] = created
+		}
+		return props
+	}
+	resources := map[string]map[string]string{
+		"orphan": owned("pv-orphan", "uid-orphan", old),
+		// Its PV records the resource name.
+		"used": owned("pv-used", "uid-used", old),
+		// Its PV exists, but records another resource.
+		"renamed": owned("pv-renamed", "uid-renamed", old),
+		"pending": owned("pv-pending", "uid-pending", old),
+		"young":   owned("pv-young", "uid-young", time.Now().UTC().Format(time.RFC3339)),
+		// Its age is only known from the first time it was seen.
+		"undated": owned("pv-undated", "uid-undated", ""),
+		"other-identity": func() map[string]string {
+			props := owned("pv-x", "uid-x", old)
+			props[propProvisionerId] = "other"
+			return props
+		}(),
+		"other-cluster": func() map[string]string {
+			props := owned("pv-y", "uid-y", old)
+			props[propClusterID] = "c2"
+			return props
+		}(),
+		"untagged": nil,
+	}
+
+	tests := []struct {
+		name   string
+		config GarbageCollectorConfig
+		// Resources that must be deleted.
+		deleted []string
+		// Number of orphans reported.
+		reported int
+	}{
+		{
+			name:     "report only",
+			config:   GarbageCollectorConfig{GracePeriod: time.Hour},
+			reported: 3,
+		},
+		{
+			name:     "delete",
+			config:   GarbageCollectorConfig{Delete: true, GracePeriod: time.Hour},
+			deleted:  []string{"orphan"},
+			reported: 3,
+		},
+		{
+			name:     "dry run",
+			config:   GarbageCollectorConfig{Delete: true, GracePeriod: time.Hour, DryRun: true},
+			reported: 3,
+		},
+		{
+			name:     "no grace period",
+			config:   GarbageCollectorConfig{Delete: true},
+			deleted:  []string{"orphan", "undated", "young"},
+			reported: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewFakeStorage("a")
+			for name, props := range resources {
+				if err := storage.CreateDefinition(name, props); err != nil {
+					t.Fatal(err)
+				}
+			}
+			client := newFakeClient()
+			client.classes["cls"] = &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "cls"}, Provisioner: "linstor"}
+			client.pvs["pv-used"] = &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+				Name:        "pv-used",
+				Annotations: map[string]string{annProvisionedBy: "linstor", annResourceName: "used"},
+			}}
+			client.pvs["pv-renamed"] = &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+				Name:        "pv-renamed",
+				Annotations: map[string]string{annProvisionedBy: "linstor", annResourceName: "elsewhere"},
+			}}
+			client.addClaim(&v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "pending", UID: "uid-pending"},
+				Status:     v1.PersistentVolumeClaimStatus{Phase: v1.ClaimPending},
+			})
+			p := newTestProvisioner(t, storage, client, WithClusterID("c1"))
+			recorder := record.NewFakeRecorder(100)
+			c := &GarbageCollector{
+				provisioner:     p,
+				provisionerName: "linstor",
+				config:          test.config,
+				recorder:        recorder,
+				firstSeen:       map[string]time.Time{},
+			}
+
+			if err := c.collect(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			deleted := []string{}
+			for name := range resources {
+				if info, _ := storage.Query(name); info == nil {
+					deleted = append(deleted, name)
+				}
+			}
+			sort.Strings(deleted)
+			expected := test.deleted
+			if expected == nil {
+				expected = []string{}
+			}
+			if !reflect.DeepEqual(deleted, expected) {
+				t.Errorf("deleted %v, expected %v", deleted, expected)
+			}
+
+			reported := 0
+			for len(recorder.Events) != 0 {
+				if event := <-recorder.Events; strings.HasPrefix(event, v1.EventTypeWarning) {
+					reported++
+				}
+			}
+			if reported != test.reported {
+				t.Errorf("reported %d orphans, expected %d", reported, test.reported)
+			}
+
+			// Orphans are only reported the first time they are seen.
+			if err := c.collect(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(recorder.Events) != 0 {
+				t.Errorf("orphans were reported again: %s", <-recorder.Events)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/satori/go.uuid"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultIdentityConfigMap is the name of the ConfigMap the identity is
+// stored in if neither an identity, an identity file nor an identity
+// ConfigMap is configured. Unlike a file in the container it survives
+// restarts.
+const DefaultIdentityConfigMap = "linstor-provisioner-identity"
+
+func newIdentity() types.UID {
+	return types.UID(uuid.NewV4().String())
+}
+
+// LoadIdentityFile returns the identity stored in path. If path doesn't
+// exist, a new identity is generated and written to it.
+func LoadIdentityFile(path string) (types.UID, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if id == "" {
+			return "", fmt.Errorf("identity file %s is empty", path)
+		}
+		return types.UID(id), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("unable to read identity file %s: %v", path, err)
+	}
+
+	id := newIdentity()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("unable to create directory of identity file %s: %v", path, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("unable to write identity file %s: %v", path, err)
+	}
+	glog.Infof("Generated new provisioner identity %s in %s", id, path)
+
+	return id, nil
+}
+
+// LoadIdentityConfigMap returns the identity stored under key in the
+// ConfigMap namespace/name. A missing ConfigMap or key is created with a newly
+// generated identity.
+func LoadIdentityConfigMap(client kubernetes.Interface, namespace, name, key string) (types.UID, error) {
+	cms := client.CoreV1().ConfigMaps(namespace)
+
+	for {
+		cm, err := cms.Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			id := newIdentity()
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       map[string]string{key: string(id)},
+			}
+			_, err = cms.Create(cm)
+			if apierrors.IsAlreadyExists(err) {
+				// Another instance was faster, use whatever it stored.
+				continue
+			}
+			if err != nil {
+				return "", fmt.Errorf("unable to create identity ConfigMap %s/%s: %v", namespace, name, err)
+			}
+			glog.Infof("Generated new provisioner identity %s in ConfigMap %s/%s", id, namespace, name)
+			return id, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to get identity ConfigMap %s/%s: %v", namespace, name, err)
+		}
+
+		if id := cm.Data[key]; id != "" {
+			return types.UID(id), nil
+		}
+
+		id := newIdentity()
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[key] = string(id)
+		_, err = cms.Update(cm)
+		if apierrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to update identity ConfigMap %s/%s: %v", namespace, name, err)
+		}
+		glog.Infof("Generated new provisioner identity %s in ConfigMap %s/%s", id, namespace, name)
+		return id, nil
+	}
+}
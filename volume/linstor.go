@@ -0,0 +1,354 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// Ports of the LINSTOR REST API if an endpoint doesn't specify one.
+	defaultLinstorPort    = "3370"
+	defaultLinstorTLSPort = "3371"
+	// Environment variable with the controllers to use if a StorageClass
+	// doesn't list any.
+	linstorControllersEnv = "LS_CONTROLLERS"
+
+	linstorRequestTimeout  = 2 * time.Minute
+	linstorIdleConnTimeout = 90 * time.Second
+)
+
+// linstorClient is a client for the REST API of a LINSTOR controller.
+// Requests are sent to the first endpoint that accepts a connection.
+type linstorClient struct {
+	endpoints  []*url.URL
+	httpClient *http.Client
+}
+
+// newLinstorClient creates a client for a comma separated list of LINSTOR
+// controllers. Every entry is either a URL or a host with an optional port.
+// If controllers is empty, the LS_CONTROLLERS environment variable is used
+// and then localhost.
+func newLinstorClient(controllers string) (*linstorClient, error) {
+	return newLinstorClientTransport(controllers, nil)
+}
+
+// newLinstorTransport returns a transport that uses tlsConfig. Idle
+// connections are closed after a while, so a transport that is replaced
+// doesn't keep its connections open.
+func newLinstorTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: linstorIdleConnTimeout,
+	}
+}
+
+// newLinstorClientTransport creates a client like newLinstorClient that sends
+// its requests through transport, if it isn't nil. If the transport has TLS
+// settings, endpoints default to https, and plain http endpoints are rejected
+// so the settings can't be bypassed.
+func newLinstorClientTransport(controllers string, transport *http.Transport) (*linstorClient, error) {
+	if controllers == "" {
+		controllers = os.Getenv(linstorControllersEnv)
+	}
+	if controllers == "" {
+		controllers = "localhost"
+	}
+
+	c := &linstorClient{
+		httpClient: &http.Client{Timeout: linstorRequestTimeout},
+	}
+	secure := false
+	if transport != nil {
+		c.httpClient.Transport = transport
+		secure = transport.TLSClientConfig != nil
+	}
+	for _, ep := range strings.Split(controllers, ",") {
+		ep = strings.TrimSpace(ep)
+		if ep == "" {
+			continue
+		}
+		u, err := parseEndpoint(ep, secure)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LINSTOR controller %q: %v", ep, err)
+		}
+		c.endpoints = append(c.endpoints, u)
+	}
+	if len(c.endpoints) == 0 {
+		return nil, fmt.Errorf("no LINSTOR controllers in %q", controllers)
+	}
+
+	return c, nil
+}
+
+func parseEndpoint(ep string, secure bool) (*url.URL, error) {
+	if !strings.Contains(ep, "://") {
+		if secure {
+			ep = "https://" + ep
+		} else {
+			ep = "http://" + ep
+		}
+	}
+	u, err := url.Parse(ep)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host")
+	}
+	if secure && u.Scheme != "https" {
+		return nil, fmt.Errorf("TLS settings require https, not %s", u.Scheme)
+	}
+	if u.Port() == "" && u.Scheme == "https" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultLinstorTLSPort)
+	} else if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultLinstorPort)
+	}
+	return u, nil
+}
+
+// do sends a request with the JSON encoding of in as body to path and decodes
+// the response into out. in and out may be nil. Responses that only carry
+// return codes are checked for errors.
+func (c *linstorClient) do(method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	var lastErr error
+	for _, ep := range c.endpoints {
+		// path is escaped already, it must not be escaped again.
+		u := *ep
+		u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + path
+		var err error
+		if u.Path, err = url.PathUnescape(u.RawPath); err != nil {
+			return err
+		}
+
+		glog.V(4).Infof("LINSTOR request: %s %s %s", method, u.String(), body)
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			// Try the next controller.
+			lastErr = err
+			continue
+		}
+
+		return decodeResponse(resp, out)
+	}
+
+	return fmt.Errorf("unable to reach any LINSTOR controller: %v", lastErr)
+}
+
+func decodeResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return err
+	}
+	glog.V(4).Infof("LINSTOR response: %s %s", resp.Status, data)
+
+	if resp.StatusCode >= 400 {
+		e := &apiError{status: resp.StatusCode}
+		var rcs []apiCallRc
+		if json.Unmarshal(data, &rcs) == nil {
+			for _, rc := range rcs {
+				if rc.isError() {
+					e.rcs = append(e.rcs, rc)
+				}
+			}
+		}
+		return e
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("couldn't Unmarshal %s: %v", data, err)
+		}
+		return nil
+	}
+
+	// Responses without a body of interest are lists of return codes.
+	var rcs []apiCallRc
+	if len(data) == 0 || json.Unmarshal(data, &rcs) != nil {
+		return nil
+	}
+	e := &apiError{status: resp.StatusCode}
+	for _, rc := range rcs {
+		if rc.isError() {
+			e.rcs = append(e.rcs, rc)
+		}
+	}
+	if len(e.rcs) != 0 {
+		return e
+	}
+	return nil
+}
+
+func escape(s string) string {
+	return url.PathEscape(s)
+}
+
+func (c *linstorClient) createResourceDefinition(rd resourceDefinition) error {
+	return c.do("POST", "/v1/resource-definitions", resourceDefinitionCreate{ResourceDefinition: rd}, nil)
+}
+
+func (c *linstorClient) getResourceDefinition(name string) (*resourceDefinition, error) {
+	rd := &resourceDefinition{}
+	if err := c.do("GET", "/v1/resource-definitions/"+escape(name), nil, rd); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+func (c *linstorClient) listResourceDefinitions() ([]resourceDefinition, error) {
+	rds := []resourceDefinition{}
+	err := c.do("GET", "/v1/resource-definitions", nil, &rds)
+	return rds, err
+}
+
+func (c *linstorClient) deleteResourceDefinition(name string) error {
+	return c.do("DELETE", "/v1/resource-definitions/"+escape(name), nil, nil)
+}
+
+func (c *linstorClient) modifyResourceDefinition(name string, m resourceDefinitionModify) error {
+	return c.do("PUT", "/v1/resource-definitions/"+escape(name), m, nil)
+}
+
+func (c *linstorClient) createVolumeDefinition(rsc string, vd volumeDefinitionCreate) error {
+	return c.do("POST", "/v1/resource-definitions/"+escape(rsc)+"/volume-definitions", vd, nil)
+}
+
+func (c *linstorClient) listVolumeDefinitions(rsc string) ([]volumeDefinition, error) {
+	vds := []volumeDefinition{}
+	err := c.do("GET", "/v1/resource-definitions/"+escape(rsc)+"/volume-definitions", nil, &vds)
+	return vds, err
+}
+
+func (c *linstorClient) modifyVolumeDefinition(rsc string, nr int, m volumeDefinitionModify) error {
+	return c.do("PUT", fmt.Sprintf("/v1/resource-definitions/%s/volume-definitions/%d", escape(rsc), nr), m, nil)
+}
+
+func (c *linstorClient) createResource(r resource) error {
+	return c.do("POST", "/v1/resource-definitions/"+escape(r.Name)+"/resources",
+		[]resourceCreate{{Resource: r}}, nil)
+}
+
+func (c *linstorClient) listResources(rsc string) ([]resource, error) {
+	rs := []resource{}
+	err := c.do("GET", "/v1/resource-definitions/"+escape(rsc)+"/resources", nil, &rs)
+	return rs, err
+}
+
+func (c *linstorClient) autoPlace(rsc string, ap autoPlaceRequest) error {
+	return c.do("POST", "/v1/resource-definitions/"+escape(rsc)+"/autoplace", ap, nil)
+}
+
+func (c *linstorClient) listStoragePools() ([]storagePool, error) {
+	pools := []storagePool{}
+	err := c.do("GET", "/v1/view/storage-pools", nil, &pools)
+	return pools, err
+}
+
+func (c *linstorClient) createSnapshot(rsc string, snap snapshot) error {
+	return c.do("POST", "/v1/resource-definitions/"+escape(rsc)+"/snapshots", snap, nil)
+}
+
+func (c *linstorClient) getSnapshot(rsc, name string) (*snapshot, error) {
+	snaps := []snapshot{}
+	if err := c.do("GET", "/v1/resource-definitions/"+escape(rsc)+"/snapshots", nil, &snaps); err != nil {
+		return nil, err
+	}
+	for i := range snaps {
+		if snaps[i].Name == name {
+			return &snaps[i], nil
+		}
+	}
+	return nil, &apiError{status: 404}
+}
+
+func (c *linstorClient) deleteSnapshot(rsc, name string) error {
+	return c.do("DELETE", "/v1/resource-definitions/"+escape(rsc)+"/snapshots/"+escape(name), nil, nil)
+}
+
+func (c *linstorClient) restoreVolumeDefinitions(rsc, snap string, r snapshotRestore) error {
+	return c.do("POST", "/v1/resource-definitions/"+escape(rsc)+"/snapshot-restore-volume-definition/"+escape(snap), r, nil)
+}
+
+func (c *linstorClient) restoreResources(rsc, snap string, r snapshotRestore) error {
+	return c.do("POST", "/v1/resource-definitions/"+escape(rsc)+"/snapshot-restore-resource/"+escape(snap), r, nil)
+}
+
+func (c *linstorClient) getResourceGroup(name string) (*resourceGroup, error) {
+	rgs := []resourceGroup{}
+	if err := c.do("GET", "/v1/resource-groups", nil, &rgs); err != nil {
+		return nil, err
+	}
+	for i := range rgs {
+		if rgs[i].Name == name {
+			return &rgs[i], nil
+		}
+	}
+	return nil, &apiError{status: 404}
+}
+
+func (c *linstorClient) createResourceGroup(rg resourceGroup) error {
+	return c.do("POST", "/v1/resource-groups", rg, nil)
+}
+
+func (c *linstorClient) modifyResourceGroup(name string, m resourceGroupModify) error {
+	return c.do("PUT", "/v1/resource-groups/"+escape(name), m, nil)
+}
+
+func (c *linstorClient) spawnResourceGroup(name string, spawn resourceGroupSpawn) error {
+	return c.do("POST", "/v1/resource-groups/"+escape(name)+"/spawn", spawn, nil)
+}
+
+func (c *linstorClient) enterPassphrase(passphrase string) error {
+	return c.do("PATCH", "/v1/encryption/passphrase", passphrase, nil)
+}
+
+func (c *linstorClient) changePassphrase(m passphraseModify) error {
+	return c.do("PUT", "/v1/encryption/passphrase", m, nil)
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Request and response bodies of the LINSTOR controller REST API (v1).
+
+const (
+	// Return code masks, see ApiConsts of the LINSTOR controller.
+	maskError = 0xC000000000000000
+	maskWarn  = 0x8000000000000000
+	maskInfo  = 0x4000000000000000
+	// The low bits of a return code identify the actual cause.
+	maskCause = 0x000000000000FFFF
+
+	failNotFoundNode     = 300
+	failNotFoundRscDfn   = 301
+	failNotFoundRsc      = 302
+	failNotFoundVlmDfn   = 303
+	failNotFoundStorPool = 306
+)
+
+// Resource flags as reported by the LINSTOR controller.
+const (
+	flagDiskless  = "DISKLESS"
+	flagEncrypted = "ENCRYPTED"
+	// Set on snapshots that were taken on all nodes.
+	flagSuccessful = "SUCCESSFUL"
+)
+
+// apiCallRc is a single return code of a LINSTOR API call.
+type apiCallRc struct {
+	RetCode        int64             `json:"ret_code"`
+	Message        string            `json:"message"`
+	Cause          string            `json:"cause,omitempty"`
+	Details        string            `json:"details,omitempty"`
+	Correction     string            `json:"correction,omitempty"`
+	ErrorReportIds []string          `json:"error_report_ids,omitempty"`
+	ObjRefs        map[string]string `json:"obj_refs,omitempty"`
+}
+
+func (rc apiCallRc) isError() bool {
+	return uint64(rc.RetCode)&maskError == maskError
+}
+
+func (rc apiCallRc) cause() uint64 {
+	return uint64(rc.RetCode) & maskCause
+}
+
+func (rc apiCallRc) String() string {
+	s := rc.Message
+	if rc.Cause != "" {
+		s += ": " + rc.Cause
+	}
+	if len(rc.ErrorReportIds) != 0 {
+		s += fmt.Sprintf(" (error reports: %s)", strings.Join(rc.ErrorReportIds, ", "))
+	}
+	return s
+}
+
+// apiError is returned for every LINSTOR API call that failed on the
+// controller side.
+type apiError struct {
+	// HTTP status code of the response.
+	status int
+	// Return codes that indicate an error.
+	rcs []apiCallRc
+}
+
+func (e *apiError) Error() string {
+	if len(e.rcs) == 0 {
+		return fmt.Sprintf("LINSTOR API call failed with HTTP status %d", e.status)
+	}
+
+	msgs := make([]string, 0, len(e.rcs))
+	for _, rc := range e.rcs {
+		msgs = append(msgs, rc.String())
+	}
+	return fmt.Sprintf("LINSTOR API call failed: %s", strings.Join(msgs, "; "))
+}
+
+// hasCause reports whether any of the error return codes has one of causes.
+func (e *apiError) hasCause(causes ...uint64) bool {
+	for _, rc := range e.rcs {
+		for _, c := range causes {
+			if rc.cause() == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether err is a LINSTOR API error caused by a missing
+// object.
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	if !ok {
+		return false
+	}
+	return e.status == 404 || e.hasCause(failNotFoundNode, failNotFoundRscDfn,
+		failNotFoundRsc, failNotFoundVlmDfn, failNotFoundStorPool)
+}
+
+type resourceDefinition struct {
+	Name  string            `json:"name"`
+	UUID  string            `json:"uuid,omitempty"`
+	Props map[string]string `json:"props,omitempty"`
+	Flags []string          `json:"flags,omitempty"`
+}
+
+type resourceDefinitionCreate struct {
+	ResourceDefinition resourceDefinition `json:"resource_definition"`
+}
+
+type resourceDefinitionModify struct {
+	OverrideProps map[string]string `json:"override_props,omitempty"`
+}
+
+type volumeDefinition struct {
+	VolumeNumber int               `json:"volume_number"`
+	SizeKiB      uint64            `json:"size_kib"`
+	Props        map[string]string `json:"props,omitempty"`
+	Flags        []string          `json:"flags,omitempty"`
+}
+
+type volumeDefinitionCreate struct {
+	VolumeDefinition volumeDefinition `json:"volume_definition"`
+	// Key of an encrypted volume, generated by LINSTOR if empty.
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+type passphraseModify struct {
+	NewPassphrase string `json:"new_passphrase"`
+	OldPassphrase string `json:"old_passphrase"`
+}
+
+type volumeDefinitionModify struct {
+	SizeKiB       uint64            `json:"size_kib,omitempty"`
+	OverrideProps map[string]string `json:"override_props,omitempty"`
+	DeleteProps   []string          `json:"delete_props,omitempty"`
+}
+
+type resource struct {
+	Name     string            `json:"name"`
+	NodeName string            `json:"node_name"`
+	Props    map[string]string `json:"props,omitempty"`
+	Flags    []string          `json:"flags,omitempty"`
+}
+
+func (r resource) diskless() bool {
+	return contains(r.Flags, flagDiskless)
+}
+
+type resourceCreate struct {
+	Resource resource `json:"resource"`
+}
+
+type autoSelectFilter struct {
+	PlaceCount           uint64   `json:"place_count,omitempty"`
+	NodeNameList         []string `json:"node_name_list,omitempty"`
+	StoragePool          string   `json:"storage_pool,omitempty"`
+	NotPlaceWithRsc      []string `json:"not_place_with_rsc,omitempty"`
+	NotPlaceWithRscRegex string   `json:"not_place_with_rsc_regex,omitempty"`
+	ReplicasOnSame       []string `json:"replicas_on_same,omitempty"`
+	ReplicasOnDifferent  []string `json:"replicas_on_different,omitempty"`
+}
+
+type autoPlaceRequest struct {
+	DisklessOnRemaining bool             `json:"diskless_on_remaining"`
+	SelectFilter        autoSelectFilter `json:"select_filter"`
+}
+
+// Storage pool provider kinds.
+const (
+	providerDiskless = "DISKLESS"
+	providerLvmThin  = "LVM_THIN"
+	providerZfsThin  = "ZFS_THIN"
+)
+
+type resourceGroup struct {
+	Name         string            `json:"name"`
+	Props        map[string]string `json:"props,omitempty"`
+	SelectFilter autoSelectFilter  `json:"select_filter"`
+}
+
+type resourceGroupModify struct {
+	SelectFilter autoSelectFilter `json:"select_filter"`
+}
+
+type resourceGroupSpawn struct {
+	ResourceDefinitionName string   `json:"resource_definition_name"`
+	VolumeSizes            []uint64 `json:"volume_sizes"`
+	DefinitionsOnly        bool     `json:"definitions_only"`
+}
+
+type storagePool struct {
+	StoragePoolName string            `json:"storage_pool_name"`
+	NodeName        string            `json:"node_name"`
+	ProviderKind    string            `json:"provider_kind"`
+	Props           map[string]string `json:"props,omitempty"`
+	// Capacities are reported in KiB.
+	FreeCapacity  int64 `json:"free_capacity"`
+	TotalCapacity int64 `json:"total_capacity"`
+}
+
+type snapshotVolumeDefinition struct {
+	VolumeNumber int    `json:"volume_number"`
+	SizeKiB      uint64 `json:"size_kib"`
+}
+
+type snapshot struct {
+	Name              string                     `json:"name"`
+	ResourceName      string                     `json:"resource_name,omitempty"`
+	Nodes             []string                   `json:"nodes,omitempty"`
+	Props             map[string]string          `json:"props,omitempty"`
+	Flags             []string                   `json:"flags,omitempty"`
+	VolumeDefinitions []snapshotVolumeDefinition `json:"volume_definitions,omitempty"`
+}
+
+type snapshotRestore struct {
+	ToResource string   `json:"to_resource"`
+	Nodes      []string `json:"nodes,omitempty"`
+}
+
+func contains(data []string, candidate string) bool {
+	for _, e := range data {
+		if candidate == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// retCode returns a LINSTOR return code with mask and cause.
+func retCode(mask, cause uint64) int64 {
+	return int64(mask | cause)
+}
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		secure   bool
+		// Expected URL, empty if parsing must fail.
+		url string
+	}{
+		{endpoint: "ctrl", url: "http://ctrl:3370"},
+		{endpoint: "ctrl:1234", url: "http://ctrl:1234"},
+		{endpoint: "ctrl", secure: true, url: "https://ctrl:3371"},
+		{endpoint: "https://ctrl", url: "https://ctrl:3371"},
+		{endpoint: "https://ctrl:8443/api", secure: true, url: "https://ctrl:8443/api"},
+		{endpoint: "[fd00::1]", url: "http://[fd00::1]:3370"},
+		{endpoint: "http://ctrl", secure: true},
+		{endpoint: "http://"},
+	}
+
+	for _, test := range tests {
+		u, err := parseEndpoint(test.endpoint, test.secure)
+		if test.url == "" {
+			if err == nil {
+				t.Errorf("%s (secure: %v): expected an error, got %s", test.endpoint, test.secure, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s (secure: %v): unexpected error: %v", test.endpoint, test.secure, err)
+			continue
+		}
+		if u.String() != test.url {
+			t.Errorf("%s (secure: %v): got %s, expected %s", test.endpoint, test.secure, u, test.url)
+		}
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	errorRc := func(cause uint64, msg string) apiCallRc {
+		return apiCallRc{RetCode: retCode(maskError, cause), Message: msg}
+	}
+	tests := []struct {
+		name   string
+		status int
+		body   interface{}
+		// Whether a resource definition is decoded from the response.
+		decode bool
+		// Substring of the error, empty if the call must succeed.
+		err      string
+		notFound bool
+	}{
+		{name: "object", status: 200, body: resourceDefinition{Name: "rsc"}, decode: true},
+		{name: "empty", status: 200},
+		{name: "info", status: 201, body: []apiCallRc{{RetCode: retCode(maskInfo, 1), Message: "created"}}},
+		{
+			name:   "error return code",
+			status: 200,
+			body: []apiCallRc{
+				{RetCode: retCode(maskWarn, 1), Message: "careful"},
+				errorRc(1, "failed"),
+			},
+			err: "LINSTOR API call failed: failed",
+		},
+		{name: "invalid object", status: 200, body: "nonsense", decode: true, err: "couldn't Unmarshal"},
+		{name: "not found", status: 404, err: "HTTP status 404", notFound: true},
+		{
+			name:     "missing resource definition",
+			status:   500,
+			body:     []apiCallRc{errorRc(failNotFoundRscDfn, "no such resource definition")},
+			err:      "no such resource definition",
+			notFound: true,
+		},
+		{
+			name:   "other error",
+			status: 500,
+			body:   []apiCallRc{{RetCode: retCode(maskError, 1), Message: "broken", Cause: "disk", ErrorReportIds: []string{"r1", "r2"}}},
+			err:    "LINSTOR API call failed: broken: disk (error reports: r1, r2)",
+		},
+		{name: "error without return codes", status: 500, body: "oops", err: "HTTP status 500"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Accept") != "application/json" {
+					t.Errorf("request does not accept JSON: %v", r.Header)
+				}
+				w.WriteHeader(test.status)
+				if test.body != nil {
+					json.NewEncoder(w).Encode(test.body)
+				}
+			}))
+			defer server.Close()
+			c, err := newLinstorClient(server.URL)
+			if err != nil {
+				t.Fatalf("unable to create client: %v", err)
+			}
+
+			var out *resourceDefinition
+			if test.decode {
+				out = &resourceDefinition{}
+				err = c.do("GET", "/v1/resource-definitions/rsc", nil, out)
+			} else {
+				err = c.do("DELETE", "/v1/resource-definitions/rsc", nil, nil)
+			}
+			if isNotFound(err) != test.notFound {
+				t.Errorf("isNotFound(%v) = %v, expected %v", err, !test.notFound, test.notFound)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.decode && out.Name != "rsc" {
+				t.Errorf("got %+v, expected resource definition rsc", out)
+			}
+		})
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		notFound bool
+	}{
+		{name: "nil", err: nil},
+		{name: "other error", err: &json.SyntaxError{}},
+		{name: "status", err: &apiError{status: 404}, notFound: true},
+		{name: "node", err: &apiError{status: 500, rcs: []apiCallRc{{RetCode: retCode(maskError, failNotFoundNode)}}}, notFound: true},
+		{name: "storage pool", err: &apiError{status: 500, rcs: []apiCallRc{{RetCode: retCode(maskError, failNotFoundStorPool)}}}, notFound: true},
+		{name: "other cause", err: &apiError{status: 500, rcs: []apiCallRc{{RetCode: retCode(maskError, 1)}}}},
+	}
+
+	for _, test := range tests {
+		if got := isNotFound(test.err); got != test.notFound {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.notFound)
+		}
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	requests := 0
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.EscapedPath() != "/v1/resource-definitions/a%2Fb" {
+			t.Errorf("unexpected path %s", r.URL.EscapedPath())
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer up.Close()
+
+	c, err := newLinstorClient(down.URL + ", " + up.URL + "," + down.URL)
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	// Errors of a controller that answers are returned, not retried.
+	err = c.deleteResourceDefinition("a/b")
+	if err == nil || !strings.Contains(err.Error(), "HTTP status 500") {
+		t.Errorf("got error %v, expected the error of the reachable controller", err)
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, expected 1", requests)
+	}
+
+	c, err = newLinstorClient(down.URL + "," + down.URL)
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	err = c.deleteResourceDefinition("a")
+	if err == nil || !strings.Contains(err.Error(), "unable to reach any LINSTOR controller") {
+		t.Errorf("got error %v, expected no controller to be reachable", err)
+	}
+}
+
+func TestNewLinstorClientEndpoints(t *testing.T) {
+	if _, err := newLinstorClient(" , "); err == nil {
+		t.Errorf("expected an error for a list without controllers")
+	}
+	if _, err := newLinstorClient("a,http://"); err == nil {
+		t.Errorf("expected an error for an invalid controller")
+	}
+}
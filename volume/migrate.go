@@ -0,0 +1,68 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// annProvisionedBy is set on dynamically provisioned PVs by Kubernetes.
+const annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+
+// MigrateVolumes adds the resource annotations to PVs of provisionerName
+// that were created by older versions, so they no longer depend on their
+// FlexVolume options. PVs that change concurrently are skipped and migrated
+// on the next start.
+func MigrateVolumes(client kubernetes.Interface, provisionerName string) error {
+	pvs, err := client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list PVs: %v", err)
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Annotations[annProvisionedBy] != provisionerName {
+			continue
+		}
+		if _, ok := pv.Annotations[annProvisionerId]; !ok {
+			continue
+		}
+		if _, ok := pv.Annotations[annResourceName]; ok {
+			continue
+		}
+
+		resourceName, controllers := resourceOf(pv)
+		pv.Annotations[annResourceName] = resourceName
+		pv.Annotations[annControllers] = controllers
+
+		_, err := client.CoreV1().PersistentVolumes().Update(pv)
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("unable to migrate PV %s: %v", pv.Name, err)
+		}
+		glog.Infof("Migrated PV %s to resource annotations", pv.Name)
+	}
+
+	return nil
+}
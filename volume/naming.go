@@ -0,0 +1,109 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+)
+
+const (
+	// DefaultResourceNameTemplate names resources after the PV the
+	// ProvisionController picked, which is unique per claim.
+	DefaultResourceNameTemplate = "{{.PVName}}"
+
+	// LINSTOR resource names are limited to 48 characters.
+	maxResourceNameLength = 48
+	// Number of hex digits of the hash appended to altered names.
+	resourceNameHashLength = 8
+)
+
+// Resource names are kept to characters that are valid in LINSTOR resource
+// names and Kubernetes object names alike.
+var invalidResourceNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// resourceNameData is passed to resource name templates.
+type resourceNameData struct {
+	PVName    string
+	Namespace string
+	PVCName   string
+	UID       string
+}
+
+// resourceNamer turns claims into LINSTOR resource names.
+type resourceNamer struct {
+	tmpl *template.Template
+}
+
+func newResourceNamer(text string) (*resourceNamer, error) {
+	tmpl, err := template.New("resourceName").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource name template %q: %v", text, err)
+	}
+	return &resourceNamer{tmpl: tmpl}, nil
+}
+
+// name returns the resource name for the claim of options.
+func (n *resourceNamer) name(options controller.VolumeOptions) (string, error) {
+	data := resourceNameData{
+		PVName:    options.PVName,
+		Namespace: options.PVC.Namespace,
+		PVCName:   options.PVC.Name,
+		UID:       string(options.PVC.UID),
+	}
+
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("unable to render resource name: %v", err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("resource name template rendered an empty name")
+	}
+
+	return sanitizeResourceName(buf.String()), nil
+}
+
+// sanitizeResourceName maps raw to a valid resource name. Names that have to
+// be altered get a hash of raw appended, so different raw names don't
+// collide after sanitizing or truncating.
+func sanitizeResourceName(raw string) string {
+	name := strings.Trim(invalidResourceNameChars.ReplaceAllString(strings.ToLower(raw), "-"), "-")
+	if name == "" {
+		name = "r"
+	} else if name[0] < 'a' || name[0] > 'z' {
+		name = "r-" + name
+	}
+	if name == raw && len(name) <= maxResourceNameLength {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(raw))
+	suffix := hex.EncodeToString(sum[:])[:resourceNameHashLength]
+
+	max := maxResourceNameLength - resourceNameHashLength - 1
+	if len(name) > max {
+		name = strings.TrimRight(name[:max], "-")
+	}
+	return name + "-" + suffix
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var validResourceName = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+func TestSanitizeResourceName(t *testing.T) {
+	long := "pvc-" + strings.Repeat("0123456789", 5)
+
+	tests := []struct {
+		raw string
+		// Expected name, or its prefix before the hash if hashed.
+		name   string
+		hashed bool
+	}{
+		{raw: "pvc-1234", name: "pvc-1234"},
+		{raw: "PVC-1234", name: "pvc-1234", hashed: true},
+		{raw: "default.data_0", name: "default-data-0", hashed: true},
+		{raw: "1st", name: "r-1st", hashed: true},
+		{raw: "...", name: "r", hashed: true},
+		{raw: "-a-", name: "a", hashed: true},
+		{raw: long[:maxResourceNameLength], name: long[:maxResourceNameLength]},
+		{raw: long, name: long[:maxResourceNameLength-resourceNameHashLength-1], hashed: true},
+		// Truncation doesn't leave a dash in front of the hash.
+		{raw: strings.Repeat("a", 38) + "--b" + strings.Repeat("c", 10), name: strings.Repeat("a", 38), hashed: true},
+	}
+
+	for _, test := range tests {
+		name := sanitizeResourceName(test.raw)
+		if len(name) > maxResourceNameLength || !validResourceName.MatchString(name) {
+			t.Errorf("%q: invalid resource name %q", test.raw, name)
+		}
+		if !test.hashed {
+			if name != test.name {
+				t.Errorf("%q: got %q, expected %q", test.raw, name, test.name)
+			}
+			continue
+		}
+		if !strings.HasPrefix(name, test.name+"-") || len(name) != len(test.name)+1+resourceNameHashLength {
+			t.Errorf("%q: got %q, expected %q with a hash appended", test.raw, name, test.name)
+		}
+		if again := sanitizeResourceName(test.raw); again != name {
+			t.Errorf("%q: got %q and %q", test.raw, name, again)
+		}
+	}
+}
+
+func TestSanitizeResourceNameDistinct(t *testing.T) {
+	long := strings.Repeat("x", 60)
+	// Names that only differ in what sanitizing or truncating removes.
+	groups := [][]string{
+		{"data", "Data", "DATA"},
+		{"a.b", "a_b", "a-b", "a b"},
+		{long + "1", long + "2"},
+	}
+
+	for _, group := range groups {
+		seen := map[string]string{}
+		for _, raw := range group {
+			name := sanitizeResourceName(raw)
+			if other, ok := seen[name]; ok {
+				t.Errorf("%q and %q are both named %q", other, raw, name)
+			}
+			seen[name] = raw
+		}
+	}
+}
+
+func TestResourceNamer(t *testing.T) {
+	options := controller.VolumeOptions{
+		PVName: "pvc-1234",
+		PVC: &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "data",
+			UID:       "uid",
+		}},
+	}
+
+	tests := []struct {
+		template string
+		name     string
+		err      bool
+	}{
+		{template: DefaultResourceNameTemplate, name: "pvc-1234"},
+		{template: "{{.Namespace}}-{{.PVCName}}", name: "default-data"},
+		{template: "{{.UID}}", name: "uid"},
+		{template: "{{.Unknown}}", err: true},
+		{template: "", err: true},
+	}
+
+	for _, test := range tests {
+		namer, err := newResourceNamer(test.template)
+		if err != nil {
+			t.Fatalf("%q: %v", test.template, err)
+		}
+		name, err := namer.name(options)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", test.template, name)
+			}
+			continue
+		}
+		if err != nil || name != test.name {
+			t.Errorf("%q: got %q, %v, expected %q", test.template, name, err, test.name)
+		}
+	}
+
+	if _, err := newResourceNamer("{{"); err == nil {
+		t.Errorf("expected an error for an invalid template")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// overridePrefix marks claim annotations that override a StorageClass
+// parameter, e.g. override.linstor.linbit.com/autoPlace. PVs record the
+// overrides in effect under the same annotations.
+const overridePrefix = "override.linstor.linbit.com/"
+
+// overrideParameters merges the override annotations of claim over the
+// StorageClass parameters params. Only parameters the StorageClass lists in
+// allowedOverrides may be overridden. It returns the merged parameters and
+// the overrides.
+func overrideParameters(params map[string]string, claim *v1.PersistentVolumeClaim) (map[string]string, map[string]string, error) {
+	overrides := map[string]string{}
+	for k, v := range claim.Annotations {
+		if strings.HasPrefix(k, overridePrefix) {
+			overrides[k[len(overridePrefix):]] = v
+		}
+	}
+	if len(overrides) == 0 {
+		return params, nil, nil
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range splitOverrides(lookupParameter(params, "allowedOverrides")) {
+		allowed[strings.ToLower(name)] = true
+	}
+
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	merged := map[string]string{}
+	for k, v := range params {
+		merged[k] = v
+	}
+	for _, name := range names {
+		lower := strings.ToLower(name)
+		if !allowed[lower] {
+			errs = append(errs, fmt.Errorf("annotation %q: parameter %s may not be overridden", overridePrefix+name, name))
+			continue
+		}
+		for k := range merged {
+			if strings.ToLower(k) == lower {
+				delete(merged, k)
+			}
+		}
+		merged[name] = overrides[name]
+	}
+
+	if len(errs) != 0 {
+		return nil, nil, fmt.Errorf("invalid parameter overrides of claim %s/%s: %v", claim.Namespace, claim.Name, utilerrors.NewAggregate(errs))
+	}
+	return merged, overrides, nil
+}
+
+// splitOverrides splits the value of allowedOverrides, which may be
+// separated by commas or spaces.
+func splitOverrides(v string) []string {
+	return strings.Fields(strings.Replace(v, ",", " ", -1))
+}
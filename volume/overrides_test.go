@@ -0,0 +1,129 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOverrideParameters(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      map[string]string
+		annotations map[string]string
+		merged      map[string]string
+		overrides   map[string]string
+		// Substrings of the error, none if it must succeed.
+		errs []string
+	}{
+		{
+			name:        "no overrides",
+			params:      map[string]string{"autoPlace": "2"},
+			annotations: map[string]string{"other": "x"},
+			merged:      map[string]string{"autoPlace": "2"},
+		},
+		{
+			name:        "allowed override",
+			params:      map[string]string{"autoPlace": "2", "storagePool": "hdd", "allowedOverrides": "autoPlace"},
+			annotations: map[string]string{overridePrefix + "autoPlace": "3"},
+			merged:      map[string]string{"autoPlace": "3", "storagePool": "hdd", "allowedOverrides": "autoPlace"},
+			overrides:   map[string]string{"autoPlace": "3"},
+		},
+		{
+			name:        "names are case-insensitive",
+			params:      map[string]string{"AutoPlace": "2", "allowedOverrides": "autoplace, storagePool"},
+			annotations: map[string]string{overridePrefix + "autoPLACE": "3", overridePrefix + "StoragePool": "ssd"},
+			merged:      map[string]string{"autoPLACE": "3", "StoragePool": "ssd", "allowedOverrides": "autoplace, storagePool"},
+			overrides:   map[string]string{"autoPLACE": "3", "StoragePool": "ssd"},
+		},
+		{
+			name:        "not allowed",
+			params:      map[string]string{"autoPlace": "2", "allowedOverrides": "storagePool"},
+			annotations: map[string]string{overridePrefix + "autoPlace": "3", overridePrefix + "nodeList": "a"},
+			errs: []string{
+				"invalid parameter overrides of claim ns/claim: ",
+				`annotation "` + overridePrefix + `autoPlace": parameter autoPlace may not be overridden`,
+				`annotation "` + overridePrefix + `nodeList": parameter nodeList may not be overridden`,
+			},
+		},
+		{
+			name:        "nothing allowed",
+			params:      map[string]string{"autoPlace": "2"},
+			annotations: map[string]string{overridePrefix + "autoPlace": "3"},
+			errs:        []string{"parameter autoPlace may not be overridden"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claim := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "ns",
+				Name:        "claim",
+				Annotations: test.annotations,
+			}}
+			merged, overrides, err := overrideParameters(test.params, claim)
+			if len(test.errs) != 0 {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				for _, e := range test.errs {
+					if !strings.Contains(err.Error(), e) {
+						t.Errorf("error %q does not contain %q", err, e)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(merged, test.merged) {
+				t.Errorf("got parameters %v, expected %v", merged, test.merged)
+			}
+			if len(overrides) != 0 || len(test.overrides) != 0 {
+				if !reflect.DeepEqual(overrides, test.overrides) {
+					t.Errorf("got overrides %v, expected %v", overrides, test.overrides)
+				}
+			}
+		})
+	}
+}
+
+func TestOverrideParametersKeepsClassParameters(t *testing.T) {
+	params := map[string]string{"autoPlace": "2", "allowedOverrides": "autoPlace"}
+	claim := &v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{overridePrefix + "autoPlace": "3"},
+	}}
+	if _, _, err := overrideParameters(params, claim); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if params["autoPlace"] != "2" {
+		t.Errorf("the StorageClass parameters were modified: %v", params)
+	}
+}
+
+func TestSplitOverrides(t *testing.T) {
+	got := splitOverrides(" autoPlace,storagePool  nodeList,, ")
+	expected := []string{"autoPlace", "storagePool", "nodeList"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
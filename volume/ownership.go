@@ -0,0 +1,151 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Resource definition properties that record which Kubernetes cluster,
+// provisioner instance and claim a resource was created for.
+const (
+	propClusterID     = "Aux/k8s/cluster-id"
+	propProvisionerId = "Aux/k8s/provisioner-id"
+	propPVName        = "Aux/k8s/pv-name"
+	propPVCNamespace  = "Aux/k8s/pvc-namespace"
+	propPVCName       = "Aux/k8s/pvc-name"
+	propPVCUID        = "Aux/k8s/pvc-uid"
+	propStorageClass  = "Aux/k8s/storage-class"
+	propCreatedAt     = "Aux/k8s/created-at"
+)
+
+// ownerProps returns the ownership properties of the resource provisioned
+// for options.
+func (p *flexProvisioner) ownerProps(options controller.VolumeOptions) map[string]string {
+	props := map[string]string{
+		propProvisionerId: string(p.identity),
+		propPVName:        options.PVName,
+		propPVCNamespace:  options.PVC.Namespace,
+		propPVCName:       options.PVC.Name,
+		propPVCUID:        string(options.PVC.UID),
+		propStorageClass:  claimClass(options.PVC),
+		propCreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+	if p.clusterID != "" {
+		props[propClusterID] = p.clusterID
+	}
+	return props
+}
+
+// claimClass returns the StorageClass of claim, which may still be set by
+// the beta annotation.
+func claimClass(claim *v1.PersistentVolumeClaim) string {
+	if class, ok := claim.Annotations[v1.BetaStorageClassAnnotation]; ok {
+		return class
+	}
+	if claim.Spec.StorageClassName != nil {
+		return *claim.Spec.StorageClassName
+	}
+	return ""
+}
+
+// ownsResource reports whether the resource was created by this provisioner
+// instance in this cluster. Resources of older versions aren't tagged.
+func (p *flexProvisioner) ownsResource(info *ResourceInfo) bool {
+	if info.Props[propProvisionerId] != string(p.identity) {
+		return false
+	}
+	cluster, ok := info.Props[propClusterID]
+	return !ok || p.clusterID == "" || cluster == p.clusterID
+}
+
+// checkLeftover fails unless the existing resource info was created by this
+// provisioner instance for the claim of options and no PV uses it yet.
+func (p *flexProvisioner) checkLeftover(info *ResourceInfo, options controller.VolumeOptions) error {
+	if !p.ownsResource(info) || info.Props[propPVCUID] != string(options.PVC.UID) {
+		return fmt.Errorf("resource %s already exists and was not created for claim %s/%s, refusing to reuse it",
+			info.Name, options.PVC.Namespace, options.PVC.Name)
+	}
+	_, err := p.client.CoreV1().PersistentVolumes().Get(options.PVName, metav1.GetOptions{})
+	if err == nil {
+		return fmt.Errorf("resource %s already exists and PV %s was saved for it, refusing to reuse it", info.Name, options.PVName)
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to get PV %s: %v", options.PVName, err)
+	}
+	return nil
+}
+
+// checkAdoptable fails if the resource is tagged as belonging to another
+// provisioner instance, cluster or namespace than claim. Untagged resources
+// pass.
+func (p *flexProvisioner) checkAdoptable(info *ResourceInfo, claim *v1.PersistentVolumeClaim) error {
+	if cluster, ok := info.Props[propClusterID]; ok && p.clusterID != "" && cluster != p.clusterID {
+		return fmt.Errorf("resource %s to adopt belongs to cluster %q", info.Name, cluster)
+	}
+	if id, ok := info.Props[propProvisionerId]; ok && id != string(p.identity) {
+		return fmt.Errorf("resource %s to adopt was created by provisioner %s", info.Name, id)
+	}
+	if ns, ok := info.Props[propPVCNamespace]; ok && ns != claim.Namespace {
+		return fmt.Errorf("resource %s to adopt belongs to namespace %s, not to %s", info.Name, ns, claim.Namespace)
+	}
+	return nil
+}
+
+// checkOwner fails if the resource is tagged as belonging to another PV,
+// provisioner instance or cluster than volume. Untagged resources pass.
+func (p *flexProvisioner) checkOwner(info *ResourceInfo, volume *v1.PersistentVolume) error {
+	if _, ok := info.Props[propProvisionerId]; !ok {
+		return nil
+	}
+	if !p.ownsResource(info) {
+		return fmt.Errorf("resource %s was created by provisioner %s in cluster %q",
+			info.Name, info.Props[propProvisionerId], info.Props[propClusterID])
+	}
+	if pvName := info.Props[propPVName]; pvName != volume.Name {
+		return fmt.Errorf("resource %s belongs to PV %s, not to %s", info.Name, pvName, volume.Name)
+	}
+	return nil
+}
+
+// locateResource returns the resource of volume. Resources that aren't
+// found under the name recorded on the PV are looked up by their ownership
+// properties. It returns nil if there is none.
+func (p *flexProvisioner) locateResource(storage Storage, volume *v1.PersistentVolume) (*ResourceInfo, error) {
+	resourceName, _ := resourceOf(volume)
+	info, err := storage.Query(resourceName)
+	if err != nil || info != nil {
+		return info, err
+	}
+
+	resources, err := storage.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range resources {
+		if p.ownsResource(&resources[i]) && resources[i].Props[propPVName] == volume.Name {
+			return &resources[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,315 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// parameter parses and validates the value of a single StorageClass
+// parameter and stores it in a volumeSpec.
+type parameter func(s *volumeSpec, value string) error
+
+// parameterSchema is the schema of all StorageClass parameters, keyed by their
+// lower case name. Keys are matched case-insensitively.
+var parameterSchema = map[string]parameter{
+	"nodelist":                listParam(func(s *volumeSpec, v []string) { s.nodeList = v }),
+	"replicasonsame":          listParam(func(s *volumeSpec, v []string) { s.replicasOnSame = v }),
+	"replicasondifferent":     listParam(func(s *volumeSpec, v []string) { s.replicasOnDifferent = v }),
+	"driver":                  stringParam(func(s *volumeSpec, v string) { s.driver = v }),
+	"filesystem":              enumParam([]string{"ext2", "ext3", "ext4", "xfs"}, func(s *volumeSpec, v string) { s.fsType = v }),
+	"storagepool":             stringParam(func(s *volumeSpec, v string) { s.storagePool = v }),
+	"disklessstoragepool":     stringParam(func(s *volumeSpec, v string) { s.disklessStoragePool = v }),
+	"autoplace":               uintParam(0, 32, func(s *volumeSpec, v uint64) { s.autoPlace = v }),
+	"donotplacewithregex":     regexParam(func(s *volumeSpec, v string) { s.doNotPlaceWithRegex = v }),
+	"blocksize":               uintStringParam(512, 65536, func(s *volumeSpec, v string) { s.blockSize = v }),
+	"force":                   boolStringParam(func(s *volumeSpec, v string) { s.force = v }),
+	"xfsdiscardblocks":        boolStringParam(func(s *volumeSpec, v string) { s.xfsdiscardblocks = v }),
+	"xfsdatasu":               patternParam(`^\d+[kmg]?$`, "a number optionally followed by k, m or g", func(s *volumeSpec, v string) { s.xfsDataSU = v }),
+	"xfsdatasw":               uintStringParam(1, 1024, func(s *volumeSpec, v string) { s.xfsDataSW = v }),
+	"xfslogdev":               pathParam(func(s *volumeSpec, v string) { s.xfsLogDev = v }),
+	"mountopts":               stringParam(func(s *volumeSpec, v string) { s.mountOpts = v }),
+	"fsopts":                  stringParam(func(s *volumeSpec, v string) { s.fsOpts = v }),
+	"controllers":             controllersParam(func(s *volumeSpec, v string) { s.controllers = v }),
+	"linstorcluster":          patternParam(`^[a-zA-Z0-9][-_a-zA-Z0-9]*$`, "a profile name of letters, digits, - and _", func(s *volumeSpec, v string) { s.linstorCluster = v }),
+	"encryptvolumes":          enumParam([]string{"yes", "no"}, func(s *volumeSpec, v string) { s.encryption = v == "yes" }),
+	"pervolumekeys":           boolParam(func(s *volumeSpec, v bool) { s.volumeKeys = v }),
+	"readonly":                boolParam(func(s *volumeSpec, v bool) { s.isRO = v }),
+	"resourcegroup":           stringParam(func(s *volumeSpec, v string) { s.resourceGroup = v }),
+	"updateresourcegroup":     boolParam(func(s *volumeSpec, v bool) { s.updateResourceGroup = v }),
+	"statefulsetantiaffinity": boolParam(func(s *volumeSpec, v bool) { s.statefulSetAntiAffinity = v }),
+	"allowedoverrides":        stringParam(func(s *volumeSpec, v string) { s.allowedOverrides = splitOverrides(v) }),
+	"oversubscriptionratio":   floatParam(1, 100, func(s *volumeSpec, v float64) { s.overSubscription = v }),
+	"allowadoption":           boolParam(func(s *volumeSpec, v bool) { s.allowAdoption = v }),
+}
+
+// xfsParameters only apply to volumes with an xfs filesystem.
+var xfsParameters = []string{"xfsdiscardblocks", "xfsdatasu", "xfsdatasw", "xfslogdev"}
+
+// parseParameters validates all StorageClass parameters against the schema
+// and stores them in s. Unknown keys are rejected as the external provisioner
+// spec requires. Parameters starting with propertyPrefix are checked against
+// propertyAllowlist instead. All problems are reported in a single error.
+func parseParameters(s *volumeSpec, params map[string]string) error {
+	var errs []error
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	seen := map[string]string{}
+	for _, k := range keys {
+		v := params[k]
+		name := strings.ToLower(k)
+
+		if other, ok := seen[name]; ok {
+			errs = append(errs, fmt.Errorf("parameter %q is given twice, as %q and %q", k, other, k))
+			continue
+		}
+		seen[name] = k
+
+		if strings.HasPrefix(name, propertyPrefix) {
+			if v == "" {
+				continue
+			}
+			if err := propertyParam(s, k, v); err != nil {
+				errs = append(errs, fmt.Errorf("parameter %q: %v", k, err))
+			}
+			continue
+		}
+
+		parse, ok := parameterSchema[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown parameter %q", k))
+			continue
+		}
+		// An empty value leaves the default in place.
+		if v == "" {
+			continue
+		}
+		if err := parse(s, v); err != nil {
+			errs = append(errs, fmt.Errorf("parameter %q: %v", k, err))
+		}
+	}
+
+	if len(s.nodeList) != 0 && s.autoPlace != 0 {
+		errs = append(errs, fmt.Errorf("parameters nodeList and autoPlace are mutually exclusive"))
+	}
+	if len(s.nodeList) != 0 {
+		for _, name := range []string{"replicasonsame", "replicasondifferent", "donotplacewithregex"} {
+			if k, ok := seen[name]; ok && params[k] != "" {
+				errs = append(errs, fmt.Errorf("parameter %q only applies to autoPlace, not to nodeList", k))
+			}
+		}
+	}
+	if s.resourceGroup != "" {
+		if len(s.nodeList) != 0 {
+			errs = append(errs, fmt.Errorf("parameters nodeList and resourceGroup are mutually exclusive"))
+		}
+		if s.encryption {
+			errs = append(errs, fmt.Errorf("parameter encryptVolumes is not supported with resourceGroup"))
+		}
+	} else if s.updateResourceGroup {
+		errs = append(errs, fmt.Errorf("parameter updateResourceGroup requires resourceGroup"))
+	}
+	for _, name := range s.allowedOverrides {
+		// allowedOverrides itself can't be overridden.
+		lower := strings.ToLower(name)
+		if _, ok := parameterSchema[lower]; !ok || lower == "allowedoverrides" {
+			errs = append(errs, fmt.Errorf("parameter allowedOverrides: %q is not a parameter that can be overridden", name))
+		}
+	}
+	if s.linstorCluster != "" && s.controllers != "" {
+		errs = append(errs, fmt.Errorf("parameters controllers and linstorCluster are mutually exclusive"))
+	}
+	if s.volumeKeys && !s.encryption {
+		errs = append(errs, fmt.Errorf("parameter perVolumeKeys requires encryptVolumes"))
+	}
+	if s.fsType != "xfs" {
+		for _, name := range xfsParameters {
+			if k, ok := seen[name]; ok && params[k] != "" {
+				errs = append(errs, fmt.Errorf("parameter %q requires filesystem xfs, not %s", k, s.fsType))
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("invalid StorageClass parameters: %v", utilerrors.NewAggregate(errs))
+	}
+	return nil
+}
+
+func stringParam(set func(*volumeSpec, string)) parameter {
+	return func(s *volumeSpec, v string) error {
+		set(s, v)
+		return nil
+	}
+}
+
+// listParam parses a space separated list.
+func listParam(set func(*volumeSpec, []string)) parameter {
+	return func(s *volumeSpec, v string) error {
+		list := strings.Fields(v)
+		if len(list) == 0 {
+			return fmt.Errorf("%q is not a space separated list", v)
+		}
+		set(s, list)
+		return nil
+	}
+}
+
+func boolParam(set func(*volumeSpec, bool)) parameter {
+	return func(s *volumeSpec, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+		set(s, b)
+		return nil
+	}
+}
+
+// boolStringParam validates a boolean that is passed on unchanged.
+func boolStringParam(set func(*volumeSpec, string)) parameter {
+	return func(s *volumeSpec, v string) error {
+		if _, err := strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+		set(s, v)
+		return nil
+	}
+}
+
+func parseUint(v string, min, max uint64) (uint64, error) {
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an unsigned integer", v)
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%d is not between %d and %d", n, min, max)
+	}
+	return n, nil
+}
+
+func uintParam(min, max uint64, set func(*volumeSpec, uint64)) parameter {
+	return func(s *volumeSpec, v string) error {
+		n, err := parseUint(v, min, max)
+		if err != nil {
+			return err
+		}
+		set(s, n)
+		return nil
+	}
+}
+
+// uintStringParam validates an unsigned integer that is passed on unchanged.
+func uintStringParam(min, max uint64, set func(*volumeSpec, string)) parameter {
+	return func(s *volumeSpec, v string) error {
+		if _, err := parseUint(v, min, max); err != nil {
+			return err
+		}
+		set(s, v)
+		return nil
+	}
+}
+
+func floatParam(min, max float64, set func(*volumeSpec, float64)) parameter {
+	return func(s *volumeSpec, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+		if f < min || f > max {
+			return fmt.Errorf("%g is not between %g and %g", f, min, max)
+		}
+		set(s, f)
+		return nil
+	}
+}
+
+func enumParam(values []string, set func(*volumeSpec, string)) parameter {
+	return func(s *volumeSpec, v string) error {
+		for _, value := range values {
+			if strings.ToLower(v) == value {
+				set(s, value)
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(values, ", "))
+	}
+}
+
+func patternParam(pattern, description string, set func(*volumeSpec, string)) parameter {
+	re := regexp.MustCompile(pattern)
+	return func(s *volumeSpec, v string) error {
+		if !re.MatchString(v) {
+			return fmt.Errorf("%q is not %s", v, description)
+		}
+		set(s, v)
+		return nil
+	}
+}
+
+func regexParam(set func(*volumeSpec, string)) parameter {
+	return func(s *volumeSpec, v string) error {
+		if _, err := regexp.Compile(v); err != nil {
+			return fmt.Errorf("%q is not a valid regular expression: %v", v, err)
+		}
+		set(s, v)
+		return nil
+	}
+}
+
+func pathParam(set func(*volumeSpec, string)) parameter {
+	return func(s *volumeSpec, v string) error {
+		if !filepath.IsAbs(v) {
+			return fmt.Errorf("%q is not an absolute path", v)
+		}
+		set(s, v)
+		return nil
+	}
+}
+
+func controllersParam(set func(*volumeSpec, string)) parameter {
+	return func(s *volumeSpec, v string) error {
+		if _, err := newLinstorClient(v); err != nil {
+			return err
+		}
+		set(s, v)
+		return nil
+	}
+}
+
+// lookupParameter returns the value of a StorageClass parameter, matching
+// its name case-insensitively like parseParameters.
+func lookupParameter(params map[string]string, name string) string {
+	for k, v := range params {
+		if strings.ToLower(k) == strings.ToLower(name) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseParameters(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		// Substrings of the error, none if it must succeed.
+		errs  []string
+		check func(s *volumeSpec) bool
+	}{
+		{
+			name:   "empty",
+			params: map[string]string{},
+		},
+		{
+			name:   "keys are case-insensitive",
+			params: map[string]string{"AUTOPLACE": "2", "storagePool": "ssd", "filesystem": "XFS"},
+			check: func(s *volumeSpec) bool {
+				return s.autoPlace == 2 && s.storagePool == "ssd" && s.fsType == "xfs"
+			},
+		},
+		{
+			name:   "empty values keep the defaults",
+			params: map[string]string{"filesystem": "", "autoPlace": ""},
+			check:  func(s *volumeSpec) bool { return s.fsType == "ext4" && s.autoPlace == 0 },
+		},
+		{
+			name:   "lists",
+			params: map[string]string{"nodeList": "a  b c"},
+			check:  func(s *volumeSpec) bool { return reflect.DeepEqual(s.nodeList, []string{"a", "b", "c"}) },
+		},
+		{
+			name:   "unknown key",
+			params: map[string]string{"autoplaec": "2"},
+			errs:   []string{`unknown parameter "autoplaec"`},
+		},
+		{
+			name:   "key given twice",
+			params: map[string]string{"autoPlace": "1", "autoplace": "2"},
+			errs:   []string{"is given twice"},
+		},
+		{
+			name:   "out of range",
+			params: map[string]string{"autoPlace": "33"},
+			errs:   []string{`parameter "autoPlace": 33 is not between 0 and 32`},
+		},
+		{
+			name:   "not a boolean",
+			params: map[string]string{"readOnly": "maybe"},
+			errs:   []string{`parameter "readOnly": "maybe" is not a boolean`},
+		},
+		{
+			name:   "invalid regex",
+			params: map[string]string{"doNotPlaceWithRegex": "("},
+			errs:   []string{`parameter "doNotPlaceWithRegex": "(" is not a valid regular expression`},
+		},
+		{
+			name:   "nodeList and autoPlace",
+			params: map[string]string{"nodeList": "a", "autoPlace": "1"},
+			errs:   []string{"nodeList and autoPlace are mutually exclusive"},
+		},
+		{
+			name:   "autoPlace settings with nodeList",
+			params: map[string]string{"nodeList": "a", "replicasOnSame": "zone"},
+			errs:   []string{`parameter "replicasOnSame" only applies to autoPlace, not to nodeList`},
+		},
+		{
+			name:   "resourceGroup with nodeList and encryption",
+			params: map[string]string{"resourceGroup": "rg", "nodeList": "a", "encryptVolumes": "yes"},
+			errs: []string{
+				"nodeList and resourceGroup are mutually exclusive",
+				"encryptVolumes is not supported with resourceGroup",
+			},
+		},
+		{
+			name:   "updateResourceGroup without resourceGroup",
+			params: map[string]string{"updateResourceGroup": "true"},
+			errs:   []string{"updateResourceGroup requires resourceGroup"},
+		},
+		{
+			name:   "controllers and linstorCluster",
+			params: map[string]string{"controllers": "a:3370", "linstorCluster": "east"},
+			errs:   []string{"controllers and linstorCluster are mutually exclusive"},
+		},
+		{
+			name:   "perVolumeKeys without encryption",
+			params: map[string]string{"perVolumeKeys": "true"},
+			errs:   []string{"perVolumeKeys requires encryptVolumes"},
+		},
+		{
+			name:   "xfs parameters without xfs",
+			params: map[string]string{"xfsDataSW": "2"},
+			errs:   []string{`parameter "xfsDataSW" requires filesystem xfs, not ext4`},
+		},
+		{
+			name:   "allowedOverrides of unknown and own parameters",
+			params: map[string]string{"allowedOverrides": "autoPlace, nope allowedOverrides"},
+			errs: []string{
+				`"nope" is not a parameter that can be overridden`,
+				`"allowedOverrides" is not a parameter that can be overridden`,
+			},
+		},
+		{
+			name: "all problems in one error",
+			params: map[string]string{
+				"bogus":     "1",
+				"autoPlace": "x",
+				"nodeList":  "a",
+				"xfsLogDev": "relative",
+			},
+			errs: []string{
+				"invalid StorageClass parameters: ",
+				`unknown parameter "bogus"`,
+				`parameter "autoPlace": "x" is not an unsigned integer`,
+				`parameter "xfsLogDev": "relative" is not an absolute path`,
+				`parameter "xfsLogDev" requires filesystem xfs, not ext4`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &volumeSpec{fsType: "ext4", overSubscription: 1}
+			err := parseParameters(s, test.params)
+			if len(test.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if test.check != nil && !test.check(s) {
+					t.Errorf("unexpected spec %+v", s)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			for _, e := range test.errs {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("error %q does not contain %q", err, e)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupParameter(t *testing.T) {
+	params := map[string]string{"LinstorCluster": "east"}
+	if v := lookupParameter(params, "linstorCluster"); v != "east" {
+		t.Errorf("got %q, expected %q", v, "east")
+	}
+	if v := lookupParameter(params, "controllers"); v != "" {
+		t.Errorf("got %q for a missing parameter", v)
+	}
+}
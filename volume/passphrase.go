@@ -0,0 +1,141 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// Entries of the passphrase Secret. The previous passphrase is only
+	// needed while the passphrase is rotated.
+	passphraseEntry         = "passphrase"
+	previousPassphraseEntry = "previous-passphrase"
+)
+
+// PassphraseUnlockerConfig configures a PassphraseUnlocker.
+type PassphraseUnlockerConfig struct {
+	// Secret with the master passphrase.
+	Namespace string
+	Name      string
+	// Interval between two attempts to unlock the controllers.
+	Interval time.Duration
+}
+
+// PassphraseUnlocker enters the master passphrase of the LINSTOR clusters
+// of encrypting StorageClasses and of the default controllers, so encrypted
+// volumes can be used again after a controller restarts. A passphrase that
+// isn't accepted replaces the previous passphrase of the Secret, which
+// rotates the passphrase.
+type PassphraseUnlocker struct {
+	provisioner     *flexProvisioner
+	provisionerName string
+	config          PassphraseUnlockerConfig
+}
+
+// NewPassphraseUnlocker creates a PassphraseUnlocker for provisionerName.
+// It shares provisioner, which must have been created by
+// NewFlexProvisioner.
+func NewPassphraseUnlocker(provisioner controller.Provisioner, provisionerName string, config PassphraseUnlockerConfig) (*PassphraseUnlocker, error) {
+	p, err := sharedProvisioner(provisioner)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PassphraseUnlocker{
+		provisioner:     p,
+		provisionerName: provisionerName,
+		config:          config,
+	}, nil
+}
+
+// Run unlocks the controllers every Interval until stopCh is closed.
+func (u *PassphraseUnlocker) Run(stopCh <-chan struct{}) {
+	glog.Infof("Starting encryption passphrase unlocker")
+	wait.Until(func() {
+		if err := u.unlock(); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error unlocking LINSTOR controllers: %v", err))
+		}
+	}, u.config.Interval, stopCh)
+}
+
+func (u *PassphraseUnlocker) unlock() error {
+	client := u.provisioner.client
+
+	secret, err := client.CoreV1().Secrets(u.config.Namespace).Get(u.config.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get passphrase Secret %s/%s: %v", u.config.Namespace, u.config.Name, err)
+	}
+	passphrase := string(secret.Data[passphraseEntry])
+	previous := string(secret.Data[previousPassphraseEntry])
+	if passphrase == "" {
+		return fmt.Errorf("passphrase Secret %s/%s has no entry %s", u.config.Namespace, u.config.Name, passphraseEntry)
+	}
+
+	clusters := map[string]bool{"": true}
+	classes, err := client.StorageV1().StorageClasses().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list StorageClasses: %v", err)
+	}
+	for _, class := range classes.Items {
+		if class.Provisioner == u.provisionerName && strings.ToLower(lookupParameter(class.Parameters, "encryptVolumes")) == "yes" {
+			clusters[classCluster(class.Parameters)] = true
+		}
+	}
+
+	controllers := make([]string, 0, len(clusters))
+	for c := range clusters {
+		controllers = append(controllers, c)
+	}
+	sort.Strings(controllers)
+
+	for _, c := range controllers {
+		storage, err := u.provisioner.newStorage(c)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		if err := unlockStorage(storage, passphrase, previous); err != nil {
+			utilruntime.HandleError(fmt.Errorf("unable to unlock LINSTOR controllers %q: %v", c, err))
+		}
+	}
+	return nil
+}
+
+// unlockStorage enters passphrase. If it isn't accepted, the previous
+// passphrase is changed to it first.
+func unlockStorage(storage Storage, passphrase, previous string) error {
+	err := storage.EnterPassphrase(passphrase)
+	if err == nil || previous == "" || previous == passphrase {
+		return err
+	}
+
+	if cerr := storage.ChangePassphrase(previous, passphrase); cerr != nil {
+		return fmt.Errorf("%v, and the previous passphrase was not accepted either: %v", err, cerr)
+	}
+	glog.Infof("rotated the encryption passphrase of LINSTOR")
+	return storage.EnterPassphrase(passphrase)
+}
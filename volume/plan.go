@@ -0,0 +1,145 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// Events recorded in dry-run mode.
+	eventProvisioningPlanned = "ProvisioningPlanned"
+	eventDeletionPlanned     = "DeletionPlanned"
+)
+
+// plan describes what deploying spec would do in LINSTOR.
+func (s *volumeSpec) plan() string {
+	steps := []string{}
+
+	create := fmt.Sprintf("create resource %s with %dKiB", s.resourceName, s.requestedSize)
+	if s.resourceGroup != "" {
+		create = fmt.Sprintf("spawn resource %s with %dKiB from resource group %s", s.resourceName, s.requestedSize, s.resourceGroup)
+		if s.updateResourceGroup {
+			create = fmt.Sprintf("update resource group %s, then %s", s.resourceGroup, create)
+		}
+	}
+	if s.encryption {
+		create += ", encrypted"
+		if s.volumeKeys {
+			create += " with a key of its own"
+		}
+	}
+	steps = append(steps, create)
+
+	if s.restoreFrom != nil {
+		steps = append(steps, fmt.Sprintf("restore it from snapshot %s of resource %s",
+			s.restoreFrom.snapshot, s.restoreFrom.resource))
+	}
+	if s.cloneFrom != nil {
+		steps = append(steps, fmt.Sprintf("clone it from resource %s through temporary snapshot %s",
+			s.cloneFrom.resource, s.cloneFrom.snapshot))
+	}
+
+	if s.resourceGroup != "" {
+		steps = append(steps, fmt.Sprintf("complete the placement with the settings of resource group %s", s.resourceGroup))
+	}
+
+	placement := s.placement()
+	pool := placement.StoragePool
+	if pool == "" {
+		pool = defaultStoragePool
+	}
+	if len(placement.Nodes) != 0 {
+		steps = append(steps, fmt.Sprintf("place replicas in storage pool %s on %s", pool, strings.Join(placement.Nodes, ", ")))
+	}
+	if placement.AutoPlace != 0 {
+		auto := fmt.Sprintf("autoplace %d replicas in storage pool %s", placement.AutoPlace, pool)
+		if len(placement.AllowedNodes) != 0 {
+			auto += fmt.Sprintf(" on any of %s", strings.Join(placement.AllowedNodes, ", "))
+		}
+		if len(placement.ReplicasOnSame) != 0 {
+			auto += fmt.Sprintf(", replicas on same %s", strings.Join(placement.ReplicasOnSame, ", "))
+		}
+		if len(placement.ReplicasOnDifferent) != 0 {
+			auto += fmt.Sprintf(", replicas on different %s", strings.Join(placement.ReplicasOnDifferent, ", "))
+		}
+		if placement.DoNotPlaceWithRegex != "" {
+			auto += fmt.Sprintf(", not with resources matching %s", placement.DoNotPlaceWithRegex)
+		}
+		if len(placement.DoNotPlaceWith) != 0 {
+			auto += fmt.Sprintf(", not with resources %s", strings.Join(placement.DoNotPlaceWith, ", "))
+		}
+		if len(s.unresolvedSiblings) != 0 {
+			auto += fmt.Sprintf(", not with the resources of claims %s (their placement was not resolved)",
+				strings.Join(s.unresolvedSiblings, ", "))
+		}
+		steps = append(steps, auto)
+	}
+
+	if s.selectedNode != "" && !contains(placement.Nodes, s.selectedNode) {
+		disklessPool := s.disklessStoragePool
+		if disklessPool == "" {
+			disklessPool = defaultDisklessStoragePool
+		}
+		client := fmt.Sprintf("attach a diskless client in storage pool %s on selected node %s", disklessPool, s.selectedNode)
+		if placement.AutoPlace != 0 && s.topology.allows(s.selectedNode) && !contains(s.avoidNodes, s.selectedNode) {
+			client = fmt.Sprintf("prefer a diskful replica on selected node %s, else %s", s.selectedNode, client)
+		}
+		steps = append(steps, client)
+	}
+
+	if len(s.props) != 0 {
+		keys := make([]string, 0, len(s.props))
+		for k := range s.props {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		props := make([]string, 0, len(keys))
+		for _, k := range keys {
+			props = append(props, fmt.Sprintf("%s=%s", k, s.props[k]))
+		}
+		steps = append(steps, "set properties "+strings.Join(props, ", "))
+	}
+
+	return fmt.Sprintf("%s (via %s)", strings.Join(steps, "; "), describeCluster(s.cluster()))
+}
+
+// describeCluster names the LINSTOR cluster of a controllers string.
+func describeCluster(controllers string) string {
+	if name, ok := parseClusterProfileRef(controllers); ok {
+		return "LINSTOR cluster profile " + name
+	}
+	if controllers == "" {
+		return "the default controllers"
+	}
+	return controllers
+}
+
+// reportPlan logs plan and records it as event on obj, then returns the
+// IgnoredError that keeps the ProvisionController from going on.
+func (p *flexProvisioner) reportPlan(obj runtime.Object, reason, plan string) error {
+	glog.Infof("dry run: %s", plan)
+	p.recorder.Event(obj, v1.EventTypeNormal, reason, "dry run: "+plan)
+	return &controller.IgnoredError{Reason: "dry run: " + plan}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// propertyPrefix marks StorageClass parameters that are set as properties of
+// the resource definition, e.g. property.linstor/DrbdOptions/Net/protocol.
+const propertyPrefix = "property.linstor/"
+
+// propertyValue validates the value of a resource definition property.
+type propertyValue func(v string) error
+
+// propertyAllowlist holds the resource definition properties StorageClasses
+// may set. Property keys are case-sensitive, like in LINSTOR.
+var propertyAllowlist = map[string]propertyValue{
+	"DrbdOptions/Net/protocol":            enumValue("A", "B", "C"),
+	"DrbdOptions/Net/max-buffers":         uintValue(32, 131072),
+	"DrbdOptions/Net/sndbuf-size":         uintValue(0, 10485760),
+	"DrbdOptions/Net/rcvbuf-size":         uintValue(0, 10485760),
+	"DrbdOptions/Net/csums-alg":           anyValue,
+	"DrbdOptions/Net/verify-alg":          anyValue,
+	"DrbdOptions/Net/allow-two-primaries": enumValue("yes", "no"),
+	"DrbdOptions/Disk/al-extents":         uintValue(67, 65534),
+	"DrbdOptions/Disk/c-max-rate":         uintValue(250, 4194304),
+	"DrbdOptions/Disk/c-min-rate":         uintValue(0, 4194304),
+	"DrbdOptions/Disk/c-fill-target":      uintValue(0, 1048576),
+	"DrbdOptions/Disk/c-plan-ahead":       uintValue(0, 300),
+	"DrbdOptions/Disk/resync-rate":        uintValue(1, 4194304),
+	"DrbdOptions/Disk/on-io-error":        enumValue("pass_on", "call-local-io-error", "detach"),
+	"DrbdOptions/Disk/disk-flushes":       enumValue("yes", "no"),
+	"DrbdOptions/Disk/md-flushes":         enumValue("yes", "no"),
+	"DrbdOptions/Disk/disk-barrier":       enumValue("yes", "no"),
+	"DrbdOptions/Resource/auto-promote":   enumValue("yes", "no"),
+	"DrbdOptions/Resource/quorum":         enumValue("off", "majority", "all"),
+	"DrbdOptions/Resource/on-no-quorum":   enumValue("io-error", "suspend-io"),
+	"DrbdOptions/auto-quorum":             enumValue("io-error", "suspend-io", "disabled"),
+	"StorDriver/LvcreateOptions":          anyValue,
+	"StorDriver/ZfscreateOptions":         anyValue,
+}
+
+// propertyParam validates the StorageClass parameter k, which starts with
+// propertyPrefix, and stores the property in s.
+func propertyParam(s *volumeSpec, k, v string) error {
+	key := k[len(propertyPrefix):]
+	valid, ok := propertyAllowlist[key]
+	if !ok {
+		return fmt.Errorf("property %s may not be set by StorageClasses, allowed are %s",
+			key, strings.Join(allowedProperties(), ", "))
+	}
+	if err := valid(v); err != nil {
+		return err
+	}
+	s.props[key] = v
+	return nil
+}
+
+func allowedProperties() []string {
+	keys := make([]string, 0, len(propertyAllowlist))
+	for k := range propertyAllowlist {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func anyValue(v string) error {
+	return nil
+}
+
+func enumValue(values ...string) propertyValue {
+	return func(v string) error {
+		for _, value := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(values, ", "))
+	}
+}
+
+func uintValue(min, max uint64) propertyValue {
+	return func(v string) error {
+		_, err := parseUint(v, min, max)
+		return err
+	}
+}
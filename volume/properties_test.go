@@ -0,0 +1,101 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPropertyParameters(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		props  map[string]string
+		// Substring of the error, empty if the parameters are valid.
+		err string
+	}{
+		{
+			name: "allowed properties",
+			params: map[string]string{
+				propertyPrefix + "DrbdOptions/Net/protocol":    "C",
+				propertyPrefix + "DrbdOptions/Disk/al-extents": "6007",
+				propertyPrefix + "StorDriver/LvcreateOptions":  "--type raid1",
+			},
+			props: map[string]string{
+				"DrbdOptions/Net/protocol":    "C",
+				"DrbdOptions/Disk/al-extents": "6007",
+				"StorDriver/LvcreateOptions":  "--type raid1",
+			},
+		},
+		{
+			name:   "prefix is case-insensitive",
+			params: map[string]string{"Property.LINSTOR/DrbdOptions/Net/protocol": "A"},
+			props:  map[string]string{"DrbdOptions/Net/protocol": "A"},
+		},
+		{
+			name:   "empty values are skipped",
+			params: map[string]string{propertyPrefix + "DrbdOptions/Net/protocol": ""},
+			props:  map[string]string{},
+		},
+		{
+			name:   "outside the allowlist",
+			params: map[string]string{propertyPrefix + "DrbdOptions/Net/shared-secret": "x"},
+			err:    "property DrbdOptions/Net/shared-secret may not be set by StorageClasses",
+		},
+		{
+			name:   "ownership properties",
+			params: map[string]string{propertyPrefix + propProvisionerId: "other"},
+			err:    "property " + propProvisionerId + " may not be set by StorageClasses",
+		},
+		{
+			name:   "keys are case-sensitive",
+			params: map[string]string{propertyPrefix + "drbdoptions/net/protocol": "C"},
+			err:    "may not be set by StorageClasses",
+		},
+		{
+			name:   "invalid enum value",
+			params: map[string]string{propertyPrefix + "DrbdOptions/Net/protocol": "D"},
+			err:    `"D" is not one of A, B, C`,
+		},
+		{
+			name:   "number out of range",
+			params: map[string]string{propertyPrefix + "DrbdOptions/Disk/al-extents": "7"},
+			err:    "DrbdOptions/Disk/al-extents",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &volumeSpec{props: map[string]string{}}
+			err := parseParameters(s, test.params)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(s.props, test.props) {
+				t.Errorf("got properties %v, expected %v", s.props, test.props)
+			}
+		})
+	}
+}
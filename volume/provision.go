@@ -19,126 +19,348 @@ package volume
 
 import (
 	"fmt"
-	"os"
-	"strconv"
 	"strings"
 
-	"github.com/LINBIT/golinstor"
 	"github.com/golang/glog"
 
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
 	"k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
-	// Name of the file where an s3fsProvisioner will store its identity
-	identityFile = "flex-provisioner.identity"
-
 	// are we allowed to set this? else make up our own
 	annCreatedBy = "kubernetes.io/createdby"
 	createdBy    = "flex-dynamic-provisioner"
 
-	// A PV annotation for the identity of the s3fsProvisioner that provisioned it
+	// A PV annotation for the identity of the flexProvisioner that provisioned it
 	annProvisionerId = "Provisioner_Id"
+
+	// PV annotations that describe the backing LINSTOR resource, so Delete
+	// doesn't depend on the claim or the StorageClass.
+	annResourceName       = "linstor.linbit.com/resource-name"
+	annControllers        = "linstor.linbit.com/controllers"
+	annStoragePool        = "linstor.linbit.com/storage-pool"
+	annReplicas           = "linstor.linbit.com/replicas"
+	annProvisionerVersion = "linstor.linbit.com/provisioner-version"
 )
 
-func NewFlexProvisioner(client kubernetes.Interface) controller.Provisioner {
-	return newFlexProvisionerInternal(client)
+// Option configures a flexProvisioner created by NewFlexProvisioner.
+type Option func(*flexProvisioner) error
+
+// WithStorageProvider sets the StorageProvider volumes are created with.
+// Defaults to NewLinstorStorage.
+func WithStorageProvider(provider StorageProvider) Option {
+	return func(p *flexProvisioner) error {
+		if provider == nil {
+			return fmt.Errorf("storage provider must not be nil")
+		}
+		p.newStorage = provider
+		return nil
+	}
+}
+
+// WithIdentity sets the identity the provisioner records on its PVs. Only
+// PVs carrying this identity are deleted. Required.
+func WithIdentity(identity types.UID) Option {
+	return func(p *flexProvisioner) error {
+		p.identity = identity
+		return nil
+	}
+}
+
+// WithLegacyVolumes makes the provisioner treat PVs that carry the empty
+// identity of older versions as its own. Only one instance per provisioner
+// name should enable this.
+func WithLegacyVolumes(adopt bool) Option {
+	return func(p *flexProvisioner) error {
+		p.adoptLegacy = adopt
+		return nil
+	}
+}
+
+// WithResourceNameTemplate sets the text/template LINSTOR resource names are
+// rendered from. It may use .PVName, .Namespace, .PVCName and .UID of the
+// claim. Defaults to DefaultResourceNameTemplate.
+func WithResourceNameTemplate(text string) Option {
+	return func(p *flexProvisioner) error {
+		namer, err := newResourceNamer(text)
+		if err != nil {
+			return err
+		}
+		p.namer = namer
+		return nil
+	}
+}
+
+// WithAdoptedDeletePolicy sets what happens to the LINSTOR resource of an
+// adopted volume when its PV is deleted, either AdoptedRetain or
+// AdoptedDelete. Defaults to AdoptedRetain.
+func WithAdoptedDeletePolicy(policy string) Option {
+	return func(p *flexProvisioner) error {
+		if policy != AdoptedRetain && policy != AdoptedDelete {
+			return fmt.Errorf("invalid delete policy for adopted volumes %q, must be %q or %q", policy, AdoptedRetain, AdoptedDelete)
+		}
+		p.adoptedDeletePolicy = policy
+		return nil
+	}
+}
+
+// WithClusterID sets the ID of the Kubernetes cluster recorded on LINSTOR
+// resources. Resources tagged with another cluster ID are never deleted.
+func WithClusterID(id string) Option {
+	return func(p *flexProvisioner) error {
+		p.clusterID = id
+		return nil
+	}
+}
+
+// WithQuotaConfigMap sets the ConfigMap with the raw capacity quotas of
+// namespaces that don't have the quota annotation. Its keys are namespace
+// names, its values quantities.
+func WithQuotaConfigMap(namespace, name string) Option {
+	return func(p *flexProvisioner) error {
+		p.quotas.configMapNamespace = namespace
+		p.quotas.configMapName = name
+		return nil
+	}
+}
+
+// WithClusterProfiles sets the ConfigMap and Secret namespace/name the
+// LINSTOR cluster profiles of StorageClasses are read from.
+func WithClusterProfiles(namespace, name string) Option {
+	return func(p *flexProvisioner) error {
+		p.profiles = &clusterProfiles{client: p.client, namespace: namespace, name: name}
+		return nil
+	}
+}
+
+// WithDryRun makes the provisioner log and report the LINSTOR operations of
+// Provision and Delete as events instead of carrying them out. No PVs are
+// created or deleted.
+func WithDryRun(dryRun bool) Option {
+	return func(p *flexProvisioner) error {
+		p.dryRun = dryRun
+		return nil
+	}
+}
+
+// WithVersion sets the provisioner version recorded on PVs.
+func WithVersion(version string) Option {
+	return func(p *flexProvisioner) error {
+		p.version = version
+		return nil
+	}
 }
 
-func newFlexProvisionerInternal(client kubernetes.Interface) *flexProvisioner {
-	var identity types.UID
+func NewFlexProvisioner(client kubernetes.Interface, options ...Option) (controller.Provisioner, error) {
+	return newFlexProvisionerInternal(client, options...)
+}
+
+// sharedProvisioner returns the flexProvisioner behind provisioner, so the
+// controllers running next to the ProvisionController share its settings
+// and state.
+func sharedProvisioner(provisioner controller.Provisioner) (*flexProvisioner, error) {
+	p, ok := provisioner.(*flexProvisioner)
+	if !ok {
+		return nil, fmt.Errorf("provisioner %T was not created by NewFlexProvisioner", provisioner)
+	}
+	return p, nil
+}
+
+func newFlexProvisionerInternal(client kubernetes.Interface, options ...Option) (*flexProvisioner, error) {
+	namer, err := newResourceNamer(DefaultResourceNameTemplate)
+	if err != nil {
+		return nil, err
+	}
 
 	provisioner := &flexProvisioner{
-		client:   client,
-		identity: identity,
+		client:              client,
+		newStorage:          NewLinstorStorage,
+		namer:               namer,
+		adoptedDeletePolicy: AdoptedRetain,
+		quotas:              newQuotaTracker(client),
+	}
+
+	for _, option := range options {
+		if err := option(provisioner); err != nil {
+			return nil, err
+		}
 	}
 
-	return provisioner
+	if provisioner.profiles != nil {
+		provisioner.newStorage = provisioner.profiles.provider(provisioner.newStorage)
+	}
+	if provisioner.identity == "" {
+		return nil, fmt.Errorf("provisioner identity must not be empty")
+	}
+	if provisioner.dryRun {
+		provisioner.recorder = newEventRecorder(client, "linstor-provisioner")
+	}
+
+	return provisioner, nil
 }
 
+// flexProvisioner is shared by all provision and delete workers of the
+// ProvisionController. Everything specific to a single volume lives in a
+// volumeSpec, so the provisioner itself must stay read-only after creation.
 type flexProvisioner struct {
-	client   kubernetes.Interface
-	identity types.UID
-
-	driver string
-	fsType string
-	isRO   bool
-
-	nodeList            []string
-	replicasOnSame      []string
-	replicasOnDifferent []string
-	storagePool         string
-	disklessStoragePool string
-	blockSize           string
-	force               string
-	xfsdiscardblocks    string
-	xfsDataSU           string
-	xfsDataSW           string
-	xfsLogDev           string
-	mountOpts           string
-	fsOpts              string
-	autoPlace           uint64
-	doNotPlaceWithRegex string
-	controllers         string
-	requestedSize       uint64
-	encryption          bool
+	client      kubernetes.Interface
+	identity    types.UID
+	adoptLegacy bool
+	newStorage  StorageProvider
+	namer       *resourceNamer
+	version     string
+	clusterID   string
+
+	adoptedDeletePolicy string
+
+	dryRun   bool
+	recorder record.EventRecorder
+
+	// Synchronizes itself, the only state shared between workers.
+	quotas *quotaTracker
+
+	// LINSTOR cluster profiles, nil if none are configured.
+	profiles *clusterProfiles
 }
 
-var _ controller.Provisioner = &flexProvisioner{}
+var _ controller.BlockProvisioner = &flexProvisioner{}
+
+// SupportsBlock reports that the provisioner can serve claims with
+// volumeMode Block.
+func (p *flexProvisioner) SupportsBlock() bool {
+	return true
+}
 
 // Provision creates a volume i.e. the storage asset and returns a PV object for
 // the volume.
 func (p *flexProvisioner) Provision(options controller.VolumeOptions) (*v1.PersistentVolume, error) {
-	if err := p.validateOptions(options); err != nil {
+	adopt := options.PVC.Annotations[annAdoptResource]
+	resourceName := adopt
+	if adopt == "" {
+		var err error
+		if resourceName, err = p.namer.name(options); err != nil {
+			return nil, err
+		}
+	}
+
+	spec, err := newVolumeSpec(options, resourceName)
+	if err != nil {
+		return nil, err
+	}
+	if spec.linstorCluster != "" {
+		// The FlexVolume driver still needs the controllers.
+		profile, err := p.profiles.get(spec.linstorCluster)
+		if err != nil {
+			return nil, err
+		}
+		spec.controllers = profile.controllers
+	}
+	if adopt != "" && !spec.allowAdoption {
+		return nil, fmt.Errorf("storage class %s does not allow adopting resources, set allowAdoption to adopt %s",
+			claimClass(options.PVC), adopt)
+	}
+	if err := p.resolveDataSource(options.PVC, spec); err != nil {
 		return nil, err
 	}
+	if adopt == "" {
+		if err := p.resolveAntiAffinity(options.PVC, spec); err != nil {
+			return nil, err
+		}
+	}
 
-	resourceName := fmt.Sprintf("%s-%s",
-		options.PVC.ObjectMeta.Namespace, options.PVC.ObjectMeta.Name)
+	if p.dryRun {
+		if adopt != "" {
+			return nil, p.reportPlan(options.PVC, eventProvisioningPlanned,
+				fmt.Sprintf("adopt resource %s (via %s)", spec.resourceName, describeCluster(spec.cluster())))
+		}
+		for k, v := range p.ownerProps(options) {
+			spec.props[k] = v
+		}
+		return nil, p.reportPlan(options.PVC, eventProvisioningPlanned, spec.plan())
+	}
 
-	err := p.createVolume(options, resourceName)
+	var info *ResourceInfo
+	if adopt != "" {
+		if info, err = p.adoptVolume(spec, options.PVC); err == nil {
+			// Adopted capacity counts against the quota like provisioned
+			// capacity.
+			_, err = p.quotas.reserve(options.PVC.Namespace, spec.resourceName, info.SizeKiB, uint64(len(info.DiskfulNodes())))
+		}
+	} else {
+		if err := p.applyResourceGroup(spec); err != nil {
+			return nil, err
+		}
+		if err := p.resolveVolumeKey(options.PVC, spec); err != nil {
+			return nil, err
+		}
+		release, qerr := p.quotas.reserve(options.PVC.Namespace, spec.resourceName, spec.requestedSize, spec.replicaCount())
+		if qerr != nil {
+			return nil, qerr
+		}
+		if info, err = p.createVolume(spec, options); err != nil {
+			release()
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	capacity := options.PVC.Spec.Resources.Requests[v1.ResourceStorage]
 
 	annotations := make(map[string]string)
 	annotations[annCreatedBy] = createdBy
 
 	annotations[annProvisionerId] = string(p.identity)
+	annotations[annResourceName] = spec.resourceName
+	if spec.linstorCluster != "" {
+		annotations[annLinstorCluster] = spec.linstorCluster
+	} else {
+		annotations[annControllers] = spec.controllers
+	}
+	annotations[annReplicas] = strings.Join(info.DiskfulNodes(), ",")
+	annotations[annProvisionerVersion] = p.version
+	if spec.storagePool != "" {
+		annotations[annStoragePool] = spec.storagePool
+	}
+	for name, value := range spec.overrides {
+		annotations[overridePrefix+name] = value
+	}
+	if spec.volumeKeySecret != "" {
+		annotations[annEncryptionKeySecret] = spec.volumeKeySecret
+	}
+	affinity := nodeAffinity(options.AllowedTopologies)
+	if adopt != "" {
+		annotations[annAdopted] = "true"
+		// The claim gets the whole resource, on the nodes it is deployed to.
+		capacity = *apiresource.NewQuantity(int64(info.SizeKiB)*1024, apiresource.BinarySI)
+		affinity = restrictToNodes(affinity, info.Nodes())
+	}
 	pv := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        resourceName,
+			Name:        options.PVName,
 			Labels:      map[string]string{},
 			Annotations: annotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: options.PersistentVolumeReclaimPolicy,
 			AccessModes:                   options.PVC.Spec.AccessModes,
+			NodeAffinity:                  affinity,
+			VolumeMode:                    options.PVC.Spec.VolumeMode,
 			Capacity: v1.ResourceList{
-				v1.ResourceStorage: options.PVC.Spec.Resources.Requests[v1.ResourceStorage],
+				v1.ResourceStorage: capacity,
 			},
 			PersistentVolumeSource: v1.PersistentVolumeSource{
 
 				FlexVolume: &v1.FlexPersistentVolumeSource{
-					Driver: p.driver,
-					Options: map[string]string{
-						"disklessStoragePool": p.disklessStoragePool,
-						"blockSize":           p.blockSize,
-						"force":               p.force,
-						"xfsDiscardBlocks":    p.xfsdiscardblocks,
-						"xfsDataSU":           p.xfsDataSU,
-						"xfsDataSW":           p.xfsDataSW,
-						"xfsLogDev":           p.xfsLogDev,
-						"fsOpts":              p.fsOpts,
-						"mountOpts":           p.mountOpts,
-						"controllers":         p.controllers,
-					},
-					FSType:   p.fsType,
-					ReadOnly: p.isRO,
+					Driver:   spec.driver,
+					Options:  spec.flexVolumeOptions(),
+					FSType:   spec.fsType,
+					ReadOnly: spec.isRO,
 				},
 			},
 		},
@@ -147,125 +369,90 @@ func (p *flexProvisioner) Provision(options controller.VolumeOptions) (*v1.Persi
 	return pv, nil
 }
 
-func (p *flexProvisioner) createVolume(volumeOptions controller.VolumeOptions, resourceName string) error {
+// createVolume deploys the resource described by spec, tagged with the
+// ownership of the claim of options, and returns it as placed by the storage
+// backend.
+func (p *flexProvisioner) createVolume(spec *volumeSpec, options controller.VolumeOptions) (*ResourceInfo, error) {
+	storage, err := p.newStorage(spec.cluster())
+	if err != nil {
+		return nil, err
+	}
 
-	if volumeOptions.PVC.Spec.Selector != nil {
-		val, ok := volumeOptions.PVC.Spec.Selector.MatchLabels["linstorDoNotPlaceWith"]
-		if ok && val == "true" {
-			p.doNotPlaceWithRegex = fmt.Sprintf("%s-.*", resourceName)
+	// A resource that is already there is only taken over if an earlier
+	// attempt for the same claim left it behind, e.g. because the
+	// provisioner restarted before the PV was saved or the rollback failed.
+	existing, err := storage.Query(spec.resourceName)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if err := p.checkLeftover(existing, options); err != nil {
+			return nil, err
+		}
+		glog.Infof("resource %s was left behind by an earlier attempt for claim %s/%s, creating it again",
+			spec.resourceName, options.PVC.Namespace, options.PVC.Name)
+		if err := storage.Delete(spec.resourceName); err != nil {
+			return nil, fmt.Errorf("unable to delete leftover resource %s: %v", spec.resourceName, err)
 		}
 	}
 
-	r := linstor.NewResourceDeployment(
-		linstor.ResourceDeploymentConfig{
-			Name:                resourceName,
-			NodeList:            p.nodeList,
-			SizeKiB:             p.requestedSize,
-			StoragePool:         p.storagePool,
-			DisklessStoragePool: p.disklessStoragePool,
-			AutoPlace:           p.autoPlace,
-			DoNotPlaceWithRegex: p.doNotPlaceWithRegex,
-			ReplicasOnSame:      p.replicasOnSame,
-			ReplicasOnDifferent: p.replicasOnDifferent,
-			Encryption:          p.encryption,
-			Controllers:         p.controllers,
-			LogOut:              os.Stderr,
-		})
-
-	err := r.CreateAndAssign()
+	// Refuse early instead of leaving a partly deployed resource behind.
+	if err := checkCapacity(storage, spec); err != nil {
+		return nil, err
+	}
+
+	// Tag the resource, so it can be found if its PV is never saved.
+	for k, v := range p.ownerProps(options) {
+		spec.props[k] = v
+	}
+
+	info, err := deployVolume(storage, spec)
 	if err != nil {
-		r.Delete()
+		if derr := storage.Delete(spec.resourceName); derr != nil {
+			glog.Errorf("failed to clean up resource %s: %v", spec.resourceName, derr)
+		}
+		return nil, err
 	}
 
-	return err
+	return info, nil
 }
 
-func (p *flexProvisioner) validateOptions(volumeOptions controller.VolumeOptions) error {
-
-	// These need to be cleared as they seem to retain old values
-	p.autoPlace = 0
-	p.blockSize = ""
-	p.controllers = ""
-	p.disklessStoragePool = ""
-	p.doNotPlaceWithRegex = ""
-	p.driver = "linbit/linstor-flexvolume"
-	p.encryption = false
-	p.force = ""
-	p.fsType = "ext4"
-	p.isRO = true
-	p.nodeList = []string{}
-	p.replicasOnSame = []string{}
-	p.replicasOnDifferent = []string{}
-	p.storagePool = ""
-	p.xfsDataSU = ""
-	p.xfsDataSW = ""
-	p.xfsLogDev = ""
-	p.xfsdiscardblocks = ""
-	p.fsOpts = ""
-	p.mountOpts = ""
-
-	for k, v := range volumeOptions.Parameters {
-		switch strings.ToLower(k) {
-		case "nodelist":
-			p.nodeList = strings.Split(v, " ")
-		case "replicasonsame":
-			p.replicasOnSame = strings.Split(v, " ")
-		case "replicasondifferent":
-			p.replicasOnDifferent = strings.Split(v, " ")
-		case "driver":
-			p.driver = v
-		case "filesystem":
-			p.fsType = v
-		case "storagepool":
-			p.storagePool = v
-		case "disklessstoragepool":
-			p.disklessStoragePool = v
-		case "autoplace":
-			if v == "" {
-				v = "0"
-			}
-			autoplace, err := strconv.ParseUint(v, 10, 64)
-			if err != nil {
-				return fmt.Errorf("unable to parse %q as an integer", v)
-			}
-			p.autoPlace = autoplace
-		case "donotplacewithregex":
-			p.doNotPlaceWithRegex = v
-		case "blocksize":
-			p.blockSize = v
-		case "force":
-			p.force = v
-		case "xfsdiscardblocks":
-			p.xfsdiscardblocks = v
-		case "xfsdatasu":
-			p.xfsDataSU = v
-		case "xfsdatasw":
-			p.xfsDataSW = v
-		case "xfslogdev":
-			p.xfsLogDev = v
-		case "mountopts":
-			p.mountOpts = v
-		case "fsopts":
-			p.fsOpts = v
-		case "controllers":
-			p.controllers = v
-		case "encryptvolumes":
-			if strings.ToLower(v) == "yes" {
-				p.encryption = true
-			}
-		case "readonly":
-			if isRO, err := strconv.ParseBool(v); err == nil {
-				p.isRO = isRO
-			}
-			// External provisioner spec says to reject unknown parameters.
-		default:
-			glog.Warningf("Unknown StorageClass Parameter: %s", k)
+// deployVolume creates the resource described by spec, reusing any parts
+// that exist already. Restored and cloned volumes are grown to the requested
+// size.
+func deployVolume(storage Storage, spec *volumeSpec) (*ResourceInfo, error) {
+	// Restored and cloned volumes take their volume from the source, so
+	// they aren't spawned from the resource group.
+	if spec.resourceGroup != "" && spec.restoreFrom == nil && spec.cloneFrom == nil {
+		if err := storage.Spawn(spec.resourceName, spec.resourceGroup, spec.requestedSize, spec.props); err != nil {
+			return nil, err
 		}
+	} else if err := storage.CreateDefinition(spec.resourceName, spec.props); err != nil {
+		return nil, err
+	}
+	if spec.restoreFrom != nil {
+		if err := restoreVolume(storage, spec, spec.restoreFrom); err != nil {
+			return nil, err
+		}
+	}
+	if spec.cloneFrom != nil {
+		if err := cloneVolume(storage, spec); err != nil {
+			return nil, err
+		}
+	}
+	if err := storage.SetSize(spec.resourceName, spec.requestedSize, spec.volumeEncryption()); err != nil {
+		return nil, err
+	}
+	if err := placeVolume(storage, spec); err != nil {
+		return nil, err
 	}
 
-	capacity := volumeOptions.PVC.Spec.Resources.Requests[v1.ResourceStorage]
-	requestedBytes := capacity.Value()
-	p.requestedSize = uint64((requestedBytes / 1024) + 1)
-
-	return nil
+	info, err := storage.Query(spec.resourceName)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("resource %s vanished while it was deployed", spec.resourceName)
+	}
+	return info, nil
 }
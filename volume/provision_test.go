@@ -0,0 +1,448 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestProvisioner returns a provisioner with identity "id" that
+// provisions on storage. Namespace "ns" exists in client, without a quota.
+func newTestProvisioner(t *testing.T, storage *FakeStorage, client *fakeClient, options ...Option) *flexProvisioner {
+	if _, ok := client.namespaces["ns"]; !ok {
+		client.addNamespace("ns", nil)
+	}
+	options = append([]Option{WithIdentity("id"), WithStorageProvider(storage.Provider())}, options...)
+	p, err := newFlexProvisionerInternal(client, options...)
+	if err != nil {
+		t.Fatalf("unable to create provisioner: %v", err)
+	}
+	return p
+}
+
+// testVolumeOptions returns the options of a 1Mi claim ns/data with params.
+func testVolumeOptions(params map[string]string) controller.VolumeOptions {
+	return controller.VolumeOptions{
+		PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimDelete,
+		PVName:                        "pvc-1",
+		Parameters:                    params,
+		PVC: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "data", UID: "uid-1", Annotations: map[string]string{}},
+			Spec: v1.PersistentVolumeClaimSpec{
+				AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: apiresource.MustParse("1Mi")},
+				},
+			},
+		},
+	}
+}
+
+func TestProvision(t *testing.T) {
+	storage := NewFakeStorage("a", "b", "c")
+	p := newTestProvisioner(t, storage, newFakeClient())
+
+	pv, err := p.Provision(testVolumeOptions(map[string]string{"autoPlace": "2", "controllers": "ctrl:3370"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pv.Name != "pvc-1" {
+		t.Errorf("got PV %s, expected pvc-1", pv.Name)
+	}
+	expected := map[string]string{
+		annProvisionerId: "id",
+		annResourceName:  "pvc-1",
+		annControllers:   "ctrl:3370",
+		annReplicas:      "a,b",
+	}
+	for k, v := range expected {
+		if pv.Annotations[k] != v {
+			t.Errorf("annotation %s is %q, expected %q", k, pv.Annotations[k], v)
+		}
+	}
+	if pv.Spec.FlexVolume == nil || pv.Spec.FlexVolume.Options["controllers"] != "ctrl:3370" {
+		t.Errorf("unexpected FlexVolume source %+v", pv.Spec.FlexVolume)
+	}
+
+	info, err := storage.Query("pvc-1")
+	if err != nil || info == nil {
+		t.Fatalf("resource pvc-1 was not created: %v", err)
+	}
+	if info.SizeKiB != 1025 {
+		t.Errorf("resource has %dKiB, expected 1025KiB", info.SizeKiB)
+	}
+	if info.Props[propPVName] != "pvc-1" || info.Props[propProvisionerId] != "id" || info.Props[propPVCUID] != "uid-1" {
+		t.Errorf("resource is not tagged with its owner: %v", info.Props)
+	}
+}
+
+func TestProvisionFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		// Storage method that fails.
+		failOn string
+		// Nodes to place on, all of a, b and c if nil.
+		nodes  []string
+		pools  []StoragePoolInfo
+		params map[string]string
+		err    string
+	}{
+		{name: "definition", failOn: "CreateDefinition", err: "CreateDefinition failed"},
+		{name: "size", failOn: "SetSize", err: "SetSize failed"},
+		{name: "placement", failOn: "Place", err: "Place failed"},
+		{name: "not enough nodes", nodes: []string{}, err: "not enough nodes"},
+		{
+			name:  "not enough capacity",
+			pools: []StoragePoolInfo{{Name: defaultStoragePool, Node: "a", FreeKiB: 10}},
+			err:   "not enough free capacity",
+		},
+		{name: "invalid parameters", params: map[string]string{"bogus": "1"}, err: `unknown parameter "bogus"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewFakeStorage("a", "b", "c")
+			if test.nodes != nil {
+				storage.Nodes = test.nodes
+			}
+			storage.Pools = test.pools
+			if test.failOn != "" {
+				storage.FailOn(test.failOn, errors.New(test.failOn+" failed"))
+			}
+			// Room for a single replica of the 1025KiB volume.
+			client := newFakeClient()
+			client.addNamespace("ns", map[string]string{annRawCapacityQuota: "1100Ki"})
+			p := newTestProvisioner(t, storage, client)
+
+			_, err := p.Provision(testVolumeOptions(test.params))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, expected %q", err, test.err)
+			}
+
+			// The partly deployed resource is rolled back...
+			if info, _ := storage.Query("pvc-1"); info != nil {
+				t.Errorf("resource pvc-1 was left behind: %+v", info)
+			}
+			// ...and so is its quota reservation.
+			storage.FailOn(test.failOn, nil)
+			storage.Nodes = []string{"a"}
+			storage.Pools = nil
+			if _, err := p.Provision(testVolumeOptions(nil)); err != nil {
+				t.Errorf("provisioning after the failure: %v", err)
+			}
+		})
+	}
+}
+
+func TestProvisionExistingResource(t *testing.T) {
+	tests := []struct {
+		name  string
+		props map[string]string
+		// Whether PV pvc-1 was saved.
+		saved bool
+		// Substring of the error, empty if the resource is taken over.
+		err string
+	}{
+		{
+			name:  "leftover of the claim",
+			props: map[string]string{propProvisionerId: "id", propPVCUID: "uid-1"},
+		},
+		{
+			name:  "untagged",
+			props: map[string]string{"owner": "someone"},
+			err:   "already exists and was not created for claim ns/data",
+		},
+		{
+			name:  "other claim",
+			props: map[string]string{propProvisionerId: "id", propPVCUID: "uid-2"},
+			err:   "already exists and was not created for claim ns/data",
+		},
+		{
+			name:  "other provisioner",
+			props: map[string]string{propProvisionerId: "other", propPVCUID: "uid-1"},
+			err:   "already exists and was not created for claim ns/data",
+		},
+		{
+			name:  "PV saved",
+			props: map[string]string{propProvisionerId: "id", propPVCUID: "uid-1"},
+			saved: true,
+			err:   "PV pvc-1 was saved for it",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewFakeStorage("a", "b")
+			if err := storage.CreateDefinition("pvc-1", test.props); err != nil {
+				t.Fatal(err)
+			}
+			// A partly deployed resource without replicas.
+			if err := storage.SetSize("pvc-1", 10, nil); err != nil {
+				t.Fatal(err)
+			}
+			client := newFakeClient()
+			if test.saved {
+				client.pvs["pvc-1"] = &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"}}
+			}
+			p := newTestProvisioner(t, storage, client)
+
+			_, err := p.Provision(testVolumeOptions(map[string]string{"autoPlace": "2"}))
+			info, _ := storage.Query("pvc-1")
+			if info == nil {
+				t.Fatalf("resource pvc-1 vanished")
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, expected %q", err, test.err)
+				}
+				if info.SizeKiB != 10 || len(info.Replicas) != 0 {
+					t.Errorf("existing resource was modified: %+v", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if info.SizeKiB != 1025 || len(info.DiskfulNodes()) != 2 || info.Props[propPVName] != "pvc-1" {
+				t.Errorf("resource was not created again: %+v", info)
+			}
+		})
+	}
+}
+
+func TestProvisionQuota(t *testing.T) {
+	storage := NewFakeStorage("a", "b")
+	client := newFakeClient()
+	client.addNamespace("ns", map[string]string{annRawCapacityQuota: "2Mi"})
+	p := newTestProvisioner(t, storage, client)
+
+	// 1Mi claims are 1025KiB, two replicas exceed 2Mi.
+	_, err := p.Provision(testVolumeOptions(map[string]string{"autoPlace": "2"}))
+	if err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Fatalf("got error %v, expected the quota to be exceeded", err)
+	}
+	if info, _ := storage.Query("pvc-1"); info != nil {
+		t.Errorf("resource pvc-1 was created regardless: %+v", info)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	storage := NewFakeStorage("a", "b")
+	p := newTestProvisioner(t, storage, newFakeClient())
+	pv, err := p.Provision(testVolumeOptions(nil))
+	if err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+
+	storage.FailOn("Delete", errors.New("Delete failed"))
+	if err := p.Delete(pv); err == nil {
+		t.Errorf("expected the failure of the backend to be returned")
+	}
+	if info, _ := storage.Query("pvc-1"); info == nil {
+		t.Fatalf("resource pvc-1 vanished on a failed delete")
+	}
+
+	storage.FailOn("Delete", nil)
+	if err := p.Delete(pv); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info, _ := storage.Query("pvc-1"); info != nil {
+		t.Errorf("resource pvc-1 was not deleted")
+	}
+
+	// Deleting again finds nothing to delete.
+	if err := p.Delete(pv); err != nil {
+		t.Errorf("deleting a deleted volume: %v", err)
+	}
+}
+
+func TestDeleteRefusesForeignVolumes(t *testing.T) {
+	storage := NewFakeStorage("a")
+	p := newTestProvisioner(t, storage, newFakeClient())
+	pv, err := p.Provision(testVolumeOptions(nil))
+	if err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+
+	other := pv.DeepCopy()
+	other.Annotations[annProvisionerId] = "other"
+	err = p.Delete(other)
+	if _, ok := err.(*controller.IgnoredError); !ok {
+		t.Errorf("got error %v, expected an IgnoredError for a PV of another provisioner", err)
+	}
+
+	renamed := pv.DeepCopy()
+	renamed.Name = "pvc-2"
+	if err := p.Delete(renamed); err == nil {
+		t.Errorf("expected the resource of another PV to be refused")
+	}
+
+	if info, _ := storage.Query("pvc-1"); info == nil {
+		t.Errorf("resource pvc-1 was deleted")
+	}
+}
+
+// adoptableStorage returns a storage with node a and b and a 2MiB resource
+// "existing" with props, placed on node a.
+func adoptableStorage(t *testing.T, props map[string]string) *FakeStorage {
+	storage := NewFakeStorage("a", "b")
+	if err := storage.CreateDefinition("existing", props); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SetSize("existing", 2048, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Place("existing", Placement{Nodes: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestProvisionAdopt(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		props  map[string]string
+		// Quota annotation of namespace "ns", none if empty.
+		quota string
+		// Substring of the error, empty if adopting must succeed.
+		err string
+	}{
+		{name: "untagged", params: map[string]string{"allowAdoption": "true"}},
+		{
+			name:   "tagged for the namespace",
+			params: map[string]string{"allowAdoption": "true"},
+			props:  map[string]string{propClusterID: "c1", propProvisionerId: "id", propPVCNamespace: "ns"},
+		},
+		{name: "not allowed", err: "does not allow adopting resources"},
+		{
+			name:   "other cluster",
+			params: map[string]string{"allowAdoption": "true"},
+			props:  map[string]string{propClusterID: "c2", propProvisionerId: "id"},
+			err:    `belongs to cluster "c2"`,
+		},
+		{
+			name:   "other provisioner",
+			params: map[string]string{"allowAdoption": "true"},
+			props:  map[string]string{propProvisionerId: "other"},
+			err:    "was created by provisioner other",
+		},
+		{
+			name:   "other namespace",
+			params: map[string]string{"allowAdoption": "true"},
+			props:  map[string]string{propProvisionerId: "id", propPVCNamespace: "other"},
+			err:    "belongs to namespace other",
+		},
+		{
+			name:   "quota exceeded",
+			params: map[string]string{"allowAdoption": "true"},
+			quota:  "1Mi",
+			err:    "quota of namespace ns exceeded: 2048KiB x 1 replicas requested",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := adoptableStorage(t, test.props)
+			client := newFakeClient()
+			if test.quota != "" {
+				client.addNamespace("ns", map[string]string{annRawCapacityQuota: test.quota})
+			}
+			p := newTestProvisioner(t, storage, client, WithClusterID("c1"))
+
+			options := testVolumeOptions(test.params)
+			options.PVC.Annotations[annAdoptResource] = "existing"
+			pv, err := p.Provision(options)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			capacity := pv.Spec.Capacity[v1.ResourceStorage]
+			if capacity.Value() != 2048*1024 {
+				t.Errorf("got capacity %s, expected 2Mi", capacity.String())
+			}
+			affinity := pv.Spec.NodeAffinity
+			if affinity == nil || len(affinity.Required.NodeSelectorTerms) != 1 {
+				t.Fatalf("unexpected node affinity %+v", affinity)
+			}
+			exprs := affinity.Required.NodeSelectorTerms[0].MatchExpressions
+			if len(exprs) != 1 || exprs[0].Key != labelHostname || len(exprs[0].Values) != 1 || exprs[0].Values[0] != "a" {
+				t.Errorf("got node affinity %+v, expected node a", exprs)
+			}
+		})
+	}
+}
+
+func TestDeleteAdopted(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		// Whether the PV was saved.
+		saved   bool
+		deleted bool
+	}{
+		{name: "retain", policy: AdoptedRetain, saved: true},
+		{name: "delete", policy: AdoptedDelete, saved: true, deleted: true},
+		{name: "delete, but the PV was never saved", policy: AdoptedDelete},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := adoptableStorage(t, nil)
+			client := newFakeClient()
+			p := newTestProvisioner(t, storage, client, WithAdoptedDeletePolicy(test.policy))
+
+			options := testVolumeOptions(map[string]string{"allowAdoption": "true"})
+			options.PVC.Annotations[annAdoptResource] = "existing"
+			pv, err := p.Provision(options)
+			if err != nil {
+				t.Fatalf("adopting: %v", err)
+			}
+			if pv.Name != "pvc-1" || pv.Annotations[annResourceName] != "existing" || pv.Annotations[annAdopted] != "true" {
+				t.Fatalf("unexpected PV %s with annotations %v", pv.Name, pv.Annotations)
+			}
+			if test.saved {
+				client.pvs[pv.Name] = pv
+			}
+
+			if err := p.Delete(pv); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			info, _ := storage.Query("existing")
+			if test.deleted && info != nil {
+				t.Errorf("resource was retained")
+			}
+			if !test.deleted && info == nil {
+				t.Errorf("resource was deleted")
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Namespace annotation with the quota on the backing storage all
+	// replicas of the volumes of the namespace may use.
+	annRawCapacityQuota = "linstor.linbit.com/raw-capacity-quota"
+
+	// How long the capacity of a provisioned volume is reserved until its
+	// PV shows up.
+	quotaReservationTimeout = 10 * time.Minute
+)
+
+// quotaTracker enforces raw capacity quotas of namespaces. Quotas are read
+// from the namespace annotation and, if there is none, from the entry of
+// the namespace in the quota ConfigMap. The usage of a namespace is the
+// capacity of its PVs times their number of diskful replicas.
+type quotaTracker struct {
+	client             kubernetes.Interface
+	configMapNamespace string
+	configMapName      string
+
+	mu sync.Mutex
+	// Serializes quota checks per namespace.
+	locks map[string]*sync.Mutex
+	// Volumes provisioned whose PV may not exist yet, by namespace and
+	// resource name.
+	reserved map[string]map[string]reservation
+}
+
+type reservation struct {
+	sizeKiB uint64
+	expires time.Time
+}
+
+func newQuotaTracker(client kubernetes.Interface) *quotaTracker {
+	return &quotaTracker{
+		client:   client,
+		locks:    map[string]*sync.Mutex{},
+		reserved: map[string]map[string]reservation{},
+	}
+}
+
+// reserve reserves sizeKiB of raw capacity for the resource name in
+// namespace. It fails if that exceeds the quota of the namespace. The
+// returned function releases the reservation if the volume isn't created
+// after all.
+func (t *quotaTracker) reserve(namespace, name string, sizeKiB uint64, replicas uint64) (func(), error) {
+	release := func() {}
+
+	quota, ok, err := t.quota(namespace)
+	if err != nil || !ok {
+		return release, err
+	}
+
+	lock := t.lock(namespace)
+	lock.Lock()
+	defer lock.Unlock()
+
+	used, err := t.usage(namespace)
+	if err != nil {
+		return release, err
+	}
+	raw := sizeKiB * replicas
+	if used+raw > quota {
+		return release, fmt.Errorf("raw capacity quota of namespace %s exceeded: %dKiB x %d replicas requested, %dKiB of %dKiB used",
+			namespace, sizeKiB, replicas, used, quota)
+	}
+
+	t.mu.Lock()
+	if t.reserved[namespace] == nil {
+		t.reserved[namespace] = map[string]reservation{}
+	}
+	t.reserved[namespace][name] = reservation{sizeKiB: raw, expires: time.Now().Add(quotaReservationTimeout)}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.reserved[namespace], name)
+	}, nil
+}
+
+func (t *quotaTracker) lock(namespace string) *sync.Mutex {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.locks[namespace] == nil {
+		t.locks[namespace] = &sync.Mutex{}
+	}
+	return t.locks[namespace]
+}
+
+// quota returns the raw capacity quota of namespace in KiB, and whether it
+// has one.
+func (t *quotaTracker) quota(namespace string) (uint64, bool, error) {
+	ns, err := t.client.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to get namespace %s: %v", namespace, err)
+	}
+	value, ok := ns.Annotations[annRawCapacityQuota]
+	source := fmt.Sprintf("annotation %s of namespace %s", annRawCapacityQuota, namespace)
+
+	if !ok && t.configMapName != "" {
+		cm, err := t.client.CoreV1().ConfigMaps(t.configMapNamespace).Get(t.configMapName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return 0, false, fmt.Errorf("unable to get quota ConfigMap %s/%s: %v", t.configMapNamespace, t.configMapName, err)
+		}
+		if err == nil {
+			value, ok = cm.Data[namespace]
+			source = fmt.Sprintf("entry %s of ConfigMap %s/%s", namespace, t.configMapNamespace, t.configMapName)
+		}
+	}
+	if !ok {
+		return 0, false, nil
+	}
+
+	q, err := apiresource.ParseQuantity(value)
+	if err != nil || q.Sign() < 0 {
+		return 0, false, fmt.Errorf("invalid raw capacity quota %q in %s", value, source)
+	}
+	return uint64(q.Value() / 1024), true, nil
+}
+
+// usage returns the raw capacity used by the volumes of namespace in KiB,
+// including reservations whose PV doesn't exist yet.
+func (t *quotaTracker) usage(namespace string) (uint64, error) {
+	pvs, err := t.client.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("unable to list PVs: %v", err)
+	}
+
+	used := uint64(0)
+	existing := map[string]bool{}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		name, _ := resourceOf(pv)
+		existing[name] = true
+		if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Namespace != namespace {
+			continue
+		}
+		if _, ok := pv.Annotations[annProvisionerId]; !ok {
+			continue
+		}
+		used += rawCapacity(pv)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for name, r := range t.reserved[namespace] {
+		if existing[name] || now.After(r.expires) {
+			delete(t.reserved[namespace], name)
+			continue
+		}
+		used += r.sizeKiB
+	}
+	return used, nil
+}
+
+// rawCapacity returns the capacity of all diskful replicas of pv in KiB.
+func rawCapacity(pv *v1.PersistentVolume) uint64 {
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	return uint64(capacity.Value()/1024) * replicasOf(pv)
+}
+
+// replicasOf returns the number of diskful replicas of pv. PVs of older
+// versions don't record their replicas and count once.
+func replicasOf(pv *v1.PersistentVolume) uint64 {
+	if nodes := pv.Annotations[annReplicas]; nodes != "" {
+		return uint64(len(strings.Split(nodes, ",")))
+	}
+	return 1
+}
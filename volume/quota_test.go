@@ -0,0 +1,213 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// quotaPV returns a provisioned PV of resource name bound in namespace.
+func quotaPV(name, namespace, capacity, replicas string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				annProvisionerId: "id",
+				annReplicas:      replicas,
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: apiresource.MustParse(capacity)},
+			ClaimRef: &v1.ObjectReference{Namespace: namespace, Name: name},
+		},
+	}
+}
+
+func TestQuotaTrackerReserve(t *testing.T) {
+	tests := []struct {
+		name string
+		// Quota annotation of namespace "ns", none if empty.
+		annotation string
+		// Entry of namespace "ns" in the quota ConfigMap, none if empty.
+		configMap string
+		pvs       []*v1.PersistentVolume
+		sizeKiB   uint64
+		replicas  uint64
+		// Substring of the error, empty if the reservation must succeed.
+		err string
+	}{
+		{
+			name:     "no quota",
+			pvs:      []*v1.PersistentVolume{quotaPV("a", "ns", "1Ti", "n1,n2,n3")},
+			sizeKiB:  1 << 30,
+			replicas: 3,
+		},
+		{
+			name:       "within quota",
+			annotation: "10Mi",
+			pvs:        []*v1.PersistentVolume{quotaPV("a", "ns", "2Mi", "n1,n2")},
+			sizeKiB:    3 * 1024,
+			replicas:   2,
+		},
+		{
+			name:       "replicas count",
+			annotation: "10Mi",
+			pvs:        []*v1.PersistentVolume{quotaPV("a", "ns", "2Mi", "n1,n2,n3")},
+			sizeKiB:    3 * 1024,
+			replicas:   2,
+			err:        "raw capacity quota of namespace ns exceeded: 3072KiB x 2 replicas requested, 6144KiB of 10240KiB used",
+		},
+		{
+			name:       "PVs without replicas count once",
+			annotation: "10Mi",
+			pvs:        []*v1.PersistentVolume{quotaPV("a", "ns", "4Mi", "")},
+			sizeKiB:    3 * 1024,
+			replicas:   2,
+		},
+		{
+			name:       "other namespaces and provisioners don't count",
+			annotation: "4Mi",
+			pvs: []*v1.PersistentVolume{
+				quotaPV("a", "other", "4Mi", "n1"),
+				func() *v1.PersistentVolume {
+					pv := quotaPV("b", "ns", "4Mi", "n1")
+					delete(pv.Annotations, annProvisionerId)
+					return pv
+				}(),
+			},
+			sizeKiB:  4 * 1024,
+			replicas: 1,
+		},
+		{
+			name:      "quota from the ConfigMap",
+			configMap: "1Mi",
+			sizeKiB:   2 * 1024,
+			replicas:  1,
+			err:       "quota of namespace ns exceeded",
+		},
+		{
+			name:       "annotation takes precedence",
+			annotation: "4Mi",
+			configMap:  "1Mi",
+			sizeKiB:    2 * 1024,
+			replicas:   1,
+		},
+		{
+			name:       "invalid quota",
+			annotation: "lots",
+			sizeKiB:    1,
+			replicas:   1,
+			err:        `invalid raw capacity quota "lots" in annotation ` + annRawCapacityQuota + " of namespace ns",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeClient()
+			annotations := map[string]string{}
+			if test.annotation != "" {
+				annotations[annRawCapacityQuota] = test.annotation
+			}
+			client.addNamespace("ns", annotations)
+			if test.configMap != "" {
+				client.configMaps["kube-system/quotas"] = &v1.ConfigMap{Data: map[string]string{"ns": test.configMap}}
+			}
+			for _, pv := range test.pvs {
+				client.pvs[pv.Name] = pv
+			}
+			tracker := newQuotaTracker(client)
+			tracker.configMapNamespace = "kube-system"
+			tracker.configMapName = "quotas"
+
+			release, err := tracker.reserve("ns", "new", test.sizeKiB, test.replicas)
+			if release == nil {
+				t.Fatalf("reserve returned no release function")
+			}
+			release()
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestQuotaTrackerReservations(t *testing.T) {
+	client := newFakeClient()
+	client.addNamespace("ns", map[string]string{annRawCapacityQuota: "3Mi"})
+	tracker := newQuotaTracker(client)
+
+	releaseA, err := tracker.reserve("ns", "a", 1024, 2)
+	if err != nil {
+		t.Fatalf("reserving a: %v", err)
+	}
+	// Volumes provisioned at the same time count before their PV exists.
+	if _, err := tracker.reserve("ns", "b", 1024, 2); err == nil {
+		t.Fatalf("reserving b: expected the reservation of a to count")
+	}
+
+	// Once the PV exists, it counts instead of the reservation.
+	client.pvs["pv-a"] = quotaPV("pv-a", "ns", "1Mi", "n1,n2")
+	client.pvs["pv-a"].Annotations[annResourceName] = "a"
+	if _, err := tracker.reserve("ns", "c", 1024, 1); err != nil {
+		t.Fatalf("reserving c: %v", err)
+	}
+	if _, err := tracker.reserve("ns", "d", 1024, 1); err == nil {
+		t.Fatalf("reserving d: expected the quota to be used up")
+	}
+
+	// Releasing a reservation whose PV exists changes nothing.
+	releaseA()
+	if _, err := tracker.reserve("ns", "d", 1024, 1); err == nil {
+		t.Fatalf("reserving d after releasing a: expected the quota to be used up")
+	}
+}
+
+func TestQuotaTrackerRelease(t *testing.T) {
+	client := newFakeClient()
+	client.addNamespace("ns", map[string]string{annRawCapacityQuota: "1Mi"})
+	tracker := newQuotaTracker(client)
+
+	release, err := tracker.reserve("ns", "a", 1024, 1)
+	if err != nil {
+		t.Fatalf("reserving a: %v", err)
+	}
+	if _, err := tracker.reserve("ns", "b", 1024, 1); err == nil {
+		t.Fatalf("reserving b: expected the quota to be used up")
+	}
+	release()
+	if _, err := tracker.reserve("ns", "b", 1024, 1); err != nil {
+		t.Fatalf("reserving b after releasing a: %v", err)
+	}
+}
+
+func TestQuotaTrackerMissingNamespace(t *testing.T) {
+	tracker := newQuotaTracker(newFakeClient())
+	if _, err := tracker.reserve("ns", "a", 1, 1); err == nil {
+		t.Errorf("expected an error")
+	}
+}
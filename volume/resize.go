@@ -0,0 +1,270 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// Events recorded on claims by the ResizeController.
+	eventVolumeResizeFailed     = "VolumeResizeFailed"
+	eventVolumeResizeSuccessful = "VolumeResizeSuccessful"
+
+	// Number of failed resizes of a claim before it is only retried on resync.
+	failedResizeThreshold = 15
+)
+
+// ResizeController grows the LINSTOR volumes of bound claims whose requested
+// size exceeds their capacity. Only claims of StorageClasses that allow
+// volume expansion and PVs provisioned by this provisioner instance are
+// considered.
+type ResizeController struct {
+	provisioner     *flexProvisioner
+	provisionerName string
+	recorder        record.EventRecorder
+
+	claimInformer cache.SharedIndexInformer
+	queue         workqueue.RateLimitingInterface
+}
+
+// NewResizeController creates a ResizeController for the PVs of
+// provisionerName. It shares provisioner, which must have been created by
+// NewFlexProvisioner, so ownership of PVs is determined the same way.
+func NewResizeController(provisioner controller.Provisioner, provisionerName string, resyncPeriod time.Duration) (*ResizeController, error) {
+	p, err := sharedProvisioner(provisioner)
+	if err != nil {
+		return nil, err
+	}
+	client := p.client
+
+	c := &ResizeController{
+		provisioner:     p,
+		provisionerName: provisionerName,
+		recorder:        newEventRecorder(client, "linstor-volume-resizer"),
+		claimInformer:   informers.NewSharedInformerFactory(client, resyncPeriod).Core().V1().PersistentVolumeClaims().Informer(),
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "resize"),
+	}
+
+	c.claimInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue(newObj) },
+	})
+
+	return c, nil
+}
+
+func (c *ResizeController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Run starts workers that resize claims until stopCh is closed.
+func (c *ResizeController) Run(workers int, stopCh <-chan struct{}) {
+	defer utilruntime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	glog.Infof("Starting volume resize controller")
+	go c.claimInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.claimInformer.HasSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+}
+
+func (c *ResizeController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *ResizeController) processNextWorkItem() bool {
+	obj, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(obj)
+
+	key := obj.(string)
+	if err := c.syncClaim(key); err != nil {
+		if c.queue.NumRequeues(obj) < failedResizeThreshold {
+			c.queue.AddRateLimited(obj)
+		}
+		utilruntime.HandleError(fmt.Errorf("error resizing claim %q: %v", key, err))
+		return true
+	}
+
+	c.queue.Forget(obj)
+	return true
+}
+
+func (c *ResizeController) syncClaim(key string) error {
+	obj, exists, err := c.claimInformer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	claim := obj.(*v1.PersistentVolumeClaim)
+
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil
+	}
+	requested := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	capacity := claim.Status.Capacity[v1.ResourceStorage]
+	if requested.Cmp(capacity) <= 0 {
+		return nil
+	}
+
+	client := c.provisioner.client
+	if claim.Spec.StorageClassName == nil || *claim.Spec.StorageClassName == "" {
+		return nil
+	}
+	class, err := client.StorageV1().StorageClasses().Get(*claim.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if class.Provisioner != c.provisionerName || class.AllowVolumeExpansion == nil || !*class.AllowVolumeExpansion {
+		return nil
+	}
+
+	pv, err := client.CoreV1().PersistentVolumes().Get(claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pv.Annotations[annProvisionedBy] != c.provisionerName {
+		return nil
+	}
+	if owned, err := c.provisioner.provisioned(pv); err != nil || !owned {
+		return err
+	}
+
+	// The volume was grown already, only the claim may lag behind.
+	pvCapacity := pv.Spec.Capacity[v1.ResourceStorage]
+	if pvCapacity.Cmp(requested) >= 0 {
+		return c.finishResize(claim, pv)
+	}
+
+	if err := c.resize(claim, pv); err != nil {
+		c.recorder.Event(claim, v1.EventTypeWarning, eventVolumeResizeFailed, err.Error())
+		return err
+	}
+	return nil
+}
+
+// resize grows the LINSTOR volume and the PV, then reports the progress on
+// the claim. Filesystems are grown by the node when the volume is mounted
+// the next time.
+func (c *ResizeController) resize(claim *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) error {
+	client := c.provisioner.client
+	requested := claim.Spec.Resources.Requests[v1.ResourceStorage]
+
+	claim, err := c.setCondition(claim, v1.PersistentVolumeClaimResizing)
+	if err != nil {
+		return err
+	}
+
+	resourceName, controllers := resourceOf(pv)
+	storage, err := c.provisioner.newStorage(controllers)
+	if err != nil {
+		return err
+	}
+
+	// The increase is reserved only until the PV shows the new capacity.
+	// Resource names can't contain ':', so the key doesn't clash with the
+	// reservations of new volumes.
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	release, err := c.provisioner.quotas.reserve(claim.Namespace, "resize:"+resourceName,
+		sizeKiB(requested)-sizeKiB(capacity), replicasOf(pv))
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	if err := storage.SetSize(resourceName, sizeKiB(requested), nil); err != nil {
+		return err
+	}
+
+	grown := pv.DeepCopy()
+	grown.Spec.Capacity[v1.ResourceStorage] = requested
+	if grown, err = client.CoreV1().PersistentVolumes().Update(grown); err != nil {
+		return fmt.Errorf("unable to update capacity of PV %s: %v", pv.Name, err)
+	}
+
+	if err := c.finishResize(claim, grown); err != nil {
+		return err
+	}
+
+	c.recorder.Eventf(claim, v1.EventTypeNormal, eventVolumeResizeSuccessful,
+		"resized resource %s to %s", resourceName, requested.String())
+	return nil
+}
+
+// finishResize updates the claim of a grown PV. Raw block claims get the new
+// capacity right away, filesystem claims are marked as waiting for the
+// filesystem to be resized on the node.
+func (c *ResizeController) finishResize(claim *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) error {
+	if pv.Spec.VolumeMode == nil || *pv.Spec.VolumeMode != v1.PersistentVolumeBlock {
+		_, err := c.setCondition(claim, v1.PersistentVolumeClaimFileSystemResizePending)
+		return err
+	}
+
+	claim = claim.DeepCopy()
+	if claim.Status.Capacity == nil {
+		claim.Status.Capacity = v1.ResourceList{}
+	}
+	claim.Status.Capacity[v1.ResourceStorage] = pv.Spec.Capacity[v1.ResourceStorage]
+	claim.Status.Conditions = nil
+	_, err := c.provisioner.client.CoreV1().PersistentVolumeClaims(claim.Namespace).UpdateStatus(claim)
+	return err
+}
+
+// setCondition replaces all conditions of the claim with a single true
+// condition of type t.
+func (c *ResizeController) setCondition(claim *v1.PersistentVolumeClaim, t v1.PersistentVolumeClaimConditionType) (*v1.PersistentVolumeClaim, error) {
+	for _, cond := range claim.Status.Conditions {
+		if cond.Type == t && len(claim.Status.Conditions) == 1 {
+			return claim, nil
+		}
+	}
+
+	claim = claim.DeepCopy()
+	claim.Status.Conditions = []v1.PersistentVolumeClaimCondition{{
+		Type:               t,
+		Status:             v1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+	}}
+	return c.provisioner.client.CoreV1().PersistentVolumeClaims(claim.Namespace).UpdateStatus(claim)
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"errors"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// newTestResizeController returns a ResizeController of provisioner
+// "linstor" for p whose informer serves the claims of client.
+func newTestResizeController(t *testing.T, p *flexProvisioner, client *fakeClient) *ResizeController {
+	informer := cache.NewSharedIndexInformer(nil, &v1.PersistentVolumeClaim{}, 0, cache.Indexers{})
+	for _, claim := range client.claims {
+		if err := informer.GetStore().Add(claim); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &ResizeController{
+		provisioner:     p,
+		provisionerName: "linstor",
+		recorder:        record.NewFakeRecorder(10),
+		claimInformer:   informer,
+	}
+}
+
+// resizeFixture returns storage with the 1Mi resource "res" on node a and a
+// client with its PV "pv-1", bound to claim ns/data of class "cls" which
+// requests requested.
+func resizeFixture(t *testing.T, requested string, mode v1.PersistentVolumeMode) (*FakeStorage, *fakeClient) {
+	storage := NewFakeStorage("a")
+	if err := storage.CreateDefinition("res", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SetSize("res", 1025, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Place("res", Placement{Nodes: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeClient()
+	allow := true
+	client.classes["cls"] = &storagev1.StorageClass{
+		ObjectMeta:           metav1.ObjectMeta{Name: "cls"},
+		Provisioner:          "linstor",
+		AllowVolumeExpansion: &allow,
+	}
+	client.pvs["pv-1"] = &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pv-1",
+			Annotations: map[string]string{
+				annProvisionedBy: "linstor",
+				annProvisionerId: "id",
+				annResourceName:  "res",
+				annReplicas:      "a",
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:   v1.ResourceList{v1.ResourceStorage: apiresource.MustParse("1Mi")},
+			ClaimRef:   &v1.ObjectReference{Namespace: "ns", Name: "data"},
+			VolumeMode: &mode,
+		},
+	}
+	class := "cls"
+	client.addClaim(&v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "data"},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &class,
+			VolumeName:       "pv-1",
+			VolumeMode:       &mode,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: apiresource.MustParse(requested)},
+			},
+		},
+		Status: v1.PersistentVolumeClaimStatus{
+			Phase:    v1.ClaimBound,
+			Capacity: v1.ResourceList{v1.ResourceStorage: apiresource.MustParse("1Mi")},
+		},
+	})
+	return storage, client
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested string
+		mode      v1.PersistentVolumeMode
+		// Changes to the fixture.
+		setup func(client *fakeClient)
+		// Expected size of the resource in KiB.
+		sizeKiB uint64
+		// Expected capacity of the PV and the claim.
+		pvCapacity    string
+		claimCapacity string
+		// Expected condition of the claim, none if empty.
+		condition v1.PersistentVolumeClaimConditionType
+		err       bool
+	}{
+		{
+			name:          "grow filesystem",
+			requested:     "2Mi",
+			mode:          v1.PersistentVolumeFilesystem,
+			sizeKiB:       2049,
+			pvCapacity:    "2Mi",
+			claimCapacity: "1Mi",
+			condition:     v1.PersistentVolumeClaimFileSystemResizePending,
+		},
+		{
+			name:          "grow block",
+			requested:     "2Mi",
+			mode:          v1.PersistentVolumeBlock,
+			sizeKiB:       2049,
+			pvCapacity:    "2Mi",
+			claimCapacity: "2Mi",
+		},
+		{
+			name:          "shrink",
+			requested:     "512Ki",
+			mode:          v1.PersistentVolumeFilesystem,
+			sizeKiB:       1025,
+			pvCapacity:    "1Mi",
+			claimCapacity: "1Mi",
+		},
+		{
+			name:      "expansion not allowed",
+			requested: "2Mi",
+			mode:      v1.PersistentVolumeFilesystem,
+			setup: func(client *fakeClient) {
+				allow := false
+				client.classes["cls"].AllowVolumeExpansion = &allow
+			},
+			sizeKiB:       1025,
+			pvCapacity:    "1Mi",
+			claimCapacity: "1Mi",
+		},
+		{
+			name:      "other provisioner instance",
+			requested: "2Mi",
+			mode:      v1.PersistentVolumeFilesystem,
+			setup: func(client *fakeClient) {
+				client.pvs["pv-1"].Annotations[annProvisionerId] = "other"
+			},
+			sizeKiB:       1025,
+			pvCapacity:    "1Mi",
+			claimCapacity: "1Mi",
+		},
+		{
+			name:      "quota exceeded",
+			requested: "3Mi",
+			mode:      v1.PersistentVolumeFilesystem,
+			setup: func(client *fakeClient) {
+				client.addNamespace("ns", map[string]string{annRawCapacityQuota: "2Mi"})
+			},
+			sizeKiB:       1025,
+			pvCapacity:    "1Mi",
+			claimCapacity: "1Mi",
+			condition:     v1.PersistentVolumeClaimResizing,
+			err:           true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage, client := resizeFixture(t, test.requested, test.mode)
+			if test.setup != nil {
+				test.setup(client)
+			}
+			p := newTestProvisioner(t, storage, client)
+			c := newTestResizeController(t, p, client)
+
+			err := c.syncClaim("ns/data")
+			if test.err != (err != nil) {
+				t.Fatalf("got error %v, expected one: %v", err, test.err)
+			}
+
+			info, _ := storage.Query("res")
+			if info.SizeKiB != test.sizeKiB {
+				t.Errorf("resource has %dKiB, expected %dKiB", info.SizeKiB, test.sizeKiB)
+			}
+			pvCapacity := client.pvs["pv-1"].Spec.Capacity[v1.ResourceStorage]
+			if pvCapacity.Cmp(apiresource.MustParse(test.pvCapacity)) != 0 {
+				t.Errorf("PV has capacity %s, expected %s", pvCapacity.String(), test.pvCapacity)
+			}
+			claim := client.claims["ns/data"]
+			claimCapacity := claim.Status.Capacity[v1.ResourceStorage]
+			if claimCapacity.Cmp(apiresource.MustParse(test.claimCapacity)) != 0 {
+				t.Errorf("claim has capacity %s, expected %s", claimCapacity.String(), test.claimCapacity)
+			}
+			conditions := claim.Status.Conditions
+			if test.condition == "" && len(conditions) != 0 {
+				t.Errorf("claim has conditions %v, expected none", conditions)
+			}
+			if test.condition != "" && (len(conditions) != 1 || conditions[0].Type != test.condition) {
+				t.Errorf("claim has conditions %v, expected %s", conditions, test.condition)
+			}
+		})
+	}
+}
+
+func TestResizeReleasesReservation(t *testing.T) {
+	for _, failOn := range []string{"", "SetSize"} {
+		storage, client := resizeFixture(t, "2Mi", v1.PersistentVolumeFilesystem)
+		client.addNamespace("ns", map[string]string{annRawCapacityQuota: "10Mi"})
+		if failOn != "" {
+			storage.FailOn(failOn, errors.New(failOn+" failed"))
+		}
+		p := newTestProvisioner(t, storage, client)
+		c := newTestResizeController(t, p, client)
+
+		err := c.syncClaim("ns/data")
+		if (failOn != "") != (err != nil) {
+			t.Errorf("failing %q: unexpected error %v", failOn, err)
+		}
+		if reserved := p.quotas.reserved["ns"]; len(reserved) != 0 {
+			t.Errorf("failing %q: reservations are kept: %v", failOn, reserved)
+		}
+	}
+}
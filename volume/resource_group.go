@@ -0,0 +1,73 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+)
+
+// applyResourceGroup sets up the resource group of spec if the StorageClass
+// manages it, then completes the placement of spec with the settings of the
+// group. Settings of the StorageClass take precedence.
+func (p *flexProvisioner) applyResourceGroup(spec *volumeSpec) error {
+	if spec.resourceGroup == "" {
+		return nil
+	}
+
+	storage, err := p.newStorage(spec.cluster())
+	if err != nil {
+		return err
+	}
+
+	if spec.updateResourceGroup {
+		err := storage.SetResourceGroup(spec.resourceGroup, Placement{
+			AutoPlace:           spec.autoPlace,
+			StoragePool:         spec.storagePool,
+			DoNotPlaceWithRegex: spec.doNotPlaceWithRegex,
+			ReplicasOnSame:      spec.replicasOnSame,
+			ReplicasOnDifferent: spec.replicasOnDifferent,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	group, err := storage.QueryResourceGroup(spec.resourceGroup)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return fmt.Errorf("resource group %s does not exist", spec.resourceGroup)
+	}
+
+	if spec.autoPlace == 0 {
+		spec.autoPlace = group.AutoPlace
+	}
+	if spec.storagePool == "" {
+		spec.storagePool = group.StoragePool
+	}
+	if spec.doNotPlaceWithRegex == "" {
+		spec.doNotPlaceWithRegex = group.DoNotPlaceWithRegex
+	}
+	if len(spec.replicasOnSame) == 0 {
+		spec.replicasOnSame = group.ReplicasOnSame
+	}
+	if len(spec.replicasOnDifferent) == 0 {
+		spec.replicasOnDifferent = group.ReplicasOnDifferent
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyResourceGroup(t *testing.T) {
+	group := Placement{
+		AutoPlace:           3,
+		StoragePool:         "ssd",
+		DoNotPlaceWithRegex: "^db-",
+		ReplicasOnSame:      []string{"Aux/zone"},
+		ReplicasOnDifferent: []string{"Aux/rack"},
+	}
+	tests := []struct {
+		name string
+		spec volumeSpec
+		// Expected spec after applying the group.
+		expected volumeSpec
+		// Expected settings of the group afterwards.
+		group Placement
+		err   string
+	}{
+		{
+			name:     "no resource group",
+			spec:     volumeSpec{autoPlace: 2},
+			expected: volumeSpec{autoPlace: 2},
+			group:    group,
+		},
+		{
+			name: "unset settings are taken from the group",
+			spec: volumeSpec{resourceGroup: "rg"},
+			expected: volumeSpec{
+				resourceGroup:       "rg",
+				autoPlace:           3,
+				storagePool:         "ssd",
+				doNotPlaceWithRegex: "^db-",
+				replicasOnSame:      []string{"Aux/zone"},
+				replicasOnDifferent: []string{"Aux/rack"},
+			},
+			group: group,
+		},
+		{
+			name: "class settings take precedence",
+			spec: volumeSpec{resourceGroup: "rg", autoPlace: 2, storagePool: "hdd", replicasOnDifferent: []string{"Aux/room"}},
+			expected: volumeSpec{
+				resourceGroup:       "rg",
+				autoPlace:           2,
+				storagePool:         "hdd",
+				doNotPlaceWithRegex: "^db-",
+				replicasOnSame:      []string{"Aux/zone"},
+				replicasOnDifferent: []string{"Aux/room"},
+			},
+			group: group,
+		},
+		{
+			name: "group updated from the class",
+			spec: volumeSpec{resourceGroup: "rg", updateResourceGroup: true, autoPlace: 2, storagePool: "hdd"},
+			expected: volumeSpec{
+				resourceGroup:       "rg",
+				updateResourceGroup: true,
+				autoPlace:           2,
+				storagePool:         "hdd",
+			},
+			group: Placement{AutoPlace: 2, StoragePool: "hdd"},
+		},
+		{
+			name:  "missing group",
+			spec:  volumeSpec{resourceGroup: "missing"},
+			group: group,
+			err:   "resource group missing does not exist",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewFakeStorage()
+			if err := storage.SetResourceGroup("rg", group); err != nil {
+				t.Fatal(err)
+			}
+			p := newTestProvisioner(t, storage, newFakeClient())
+
+			spec := test.spec
+			err := p.applyResourceGroup(&spec)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(spec, test.expected) {
+				t.Errorf("got spec %+v, expected %+v", spec, test.expected)
+			}
+			got, _ := storage.QueryResourceGroup("rg")
+			if !reflect.DeepEqual(*got, test.group) {
+				t.Errorf("got group %+v, expected %+v", *got, test.group)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// API group of VolumeSnapshots referenced as claim data source.
+const snapshotAPIGroup = "snapshot.storage.k8s.io"
+
+// snapshotSource is a LINSTOR snapshot a volume is restored from.
+type snapshotSource struct {
+	resource string
+	snapshot string
+}
+
+// resolveDataSource records the data source of claim in spec. Claims without
+// one are left alone.
+func (p *flexProvisioner) resolveDataSource(claim *v1.PersistentVolumeClaim, spec *volumeSpec) error {
+	ds := claim.Spec.DataSource
+	if ds == nil {
+		return nil
+	}
+	if ds.Kind == "PersistentVolumeClaim" && (ds.APIGroup == nil || *ds.APIGroup == "") {
+		source, err := p.resolveCloneSource(claim)
+		if err != nil {
+			return err
+		}
+		spec.cloneFrom = source
+		return nil
+	}
+	if ds.Kind != kindVolumeSnapshot || ds.APIGroup == nil || *ds.APIGroup != snapshotAPIGroup {
+		return fmt.Errorf("unsupported data source %s %s", ds.Kind, ds.Name)
+	}
+
+	snapshots := newSnapshotClient(p.client)
+	snap, err := snapshots.getSnapshot(claim.Namespace, ds.Name)
+	if err != nil {
+		return fmt.Errorf("unable to get VolumeSnapshot %s: %v", ds.Name, err)
+	}
+	if !snap.Status.ReadyToUse || snap.Spec.SnapshotContentName == "" {
+		return fmt.Errorf("VolumeSnapshot %s is not ready to use", ds.Name)
+	}
+
+	content, err := snapshots.getContent(snap.Spec.SnapshotContentName)
+	if err != nil {
+		return fmt.Errorf("unable to get VolumeSnapshotContent %s: %v", snap.Spec.SnapshotContentName, err)
+	}
+	if ref := content.Spec.VolumeSnapshotRef; ref == nil || ref.UID != snap.UID {
+		return fmt.Errorf("VolumeSnapshotContent %s is not bound to VolumeSnapshot %s", content.Name, ds.Name)
+	}
+	if _, ok := content.Annotations[annSnapshotName]; !ok || content.Spec.CSI == nil {
+		return fmt.Errorf("VolumeSnapshot %s is not backed by a LINSTOR snapshot", ds.Name)
+	}
+
+	resource, snapshot, err := parseSnapshotHandle(content.Spec.CSI.SnapshotHandle)
+	if err != nil {
+		return err
+	}
+	spec.restoreFrom = &snapshotSource{resource: resource, snapshot: snapshot}
+	return nil
+}
+
+// restoreVolume creates the volume of the defined resource of spec from the
+// snapshot src. Replicas are restored on the nodes of the snapshot that fit
+// the placement of spec, the remaining ones are placed afterwards and synced
+// by DRBD.
+func restoreVolume(storage Storage, spec *volumeSpec, src *snapshotSource) error {
+	info, err := storage.QuerySnapshot(src.resource, src.snapshot)
+	if err != nil {
+		return err
+	}
+	if info == nil || !info.Ready {
+		return fmt.Errorf("snapshot %s of resource %s is not available", src.snapshot, src.resource)
+	}
+	if spec.requestedSize < info.SizeKiB {
+		return fmt.Errorf("requested size %dKiB is smaller than snapshot %s of resource %s (%dKiB)",
+			spec.requestedSize, src.snapshot, src.resource, info.SizeKiB)
+	}
+
+	nodes := restoreNodes(spec.placement(), info.Nodes)
+	if len(nodes) == 0 {
+		return fmt.Errorf("none of the nodes of snapshot %s of resource %s (%s) fits the placement of the storage class",
+			src.snapshot, src.resource, strings.Join(info.Nodes, ", "))
+	}
+
+	return storage.RestoreSnapshot(spec.resourceName, src.resource, src.snapshot, nodes)
+}
+
+// restoreNodes returns the nodes of a snapshot replicas are restored on.
+func restoreNodes(placement Placement, snapshotNodes []string) []string {
+	nodes := []string{}
+	if len(placement.Nodes) != 0 {
+		for _, node := range snapshotNodes {
+			if contains(placement.Nodes, node) {
+				nodes = append(nodes, node)
+			}
+		}
+		return nodes
+	}
+
+	for _, node := range snapshotNodes {
+		if uint64(len(nodes)) >= placement.AutoPlace {
+			break
+		}
+		if len(placement.AllowedNodes) == 0 || contains(placement.AllowedNodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestProvisionRestore(t *testing.T) {
+	tests := []struct {
+		name string
+		// Size of the resource the snapshot is taken of.
+		sourceKiB uint64
+		// UID of the VolumeSnapshot the content is bound to.
+		boundTo string
+		// Substring of the error, empty if restoring must succeed.
+		err string
+	}{
+		{name: "grown to the request", sourceKiB: 512, boundTo: "uid-snap"},
+		{name: "same size", sourceKiB: 1025, boundTo: "uid-snap"},
+		{name: "smaller than the snapshot", sourceKiB: 2048, boundTo: "uid-snap", err: "requested size 1025KiB is smaller than snapshot snap-1 of resource src (2048KiB)"},
+		{name: "content bound elsewhere", sourceKiB: 512, boundTo: "uid-other", err: "VolumeSnapshotContent content-1 is not bound to VolumeSnapshot snap"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewFakeStorage("a")
+			if err := storage.CreateDefinition("src", nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.SetSize("src", test.sourceKiB, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.Place("src", Placement{Nodes: []string{"a"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.CreateSnapshot("src", "snap-1"); err != nil {
+				t.Fatal(err)
+			}
+
+			client := newFakeClient()
+			snap := &volumeSnapshot{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "snap", UID: "uid-snap"},
+				Spec:       volumeSnapshotSpec{SnapshotContentName: "content-1"},
+				Status:     volumeSnapshotStatus{ReadyToUse: true},
+			}
+			content := &volumeSnapshotContent{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "content-1",
+					Annotations: map[string]string{annSnapshotName: "snap-1"},
+				},
+				Spec: volumeSnapshotContentSpec{
+					CSI:               &csiVolumeSnapshotSource{SnapshotHandle: snapshotHandle("src", "snap-1")},
+					VolumeSnapshotRef: &v1.ObjectReference{Namespace: "ns", Name: "snap", UID: types.UID(test.boundTo)},
+				},
+			}
+			defer client.serveObjects(t, map[string]interface{}{
+				"/apis/" + snapshotGroupVersion + "/namespaces/ns/volumesnapshots/snap": snap,
+				"/apis/" + snapshotGroupVersion + "/volumesnapshotcontents/content-1":   content,
+			})()
+			p := newTestProvisioner(t, storage, client)
+
+			options := testVolumeOptions(map[string]string{"autoPlace": "1"})
+			group := snapshotAPIGroup
+			options.PVC.Spec.DataSource = &v1.TypedLocalObjectReference{APIGroup: &group, Kind: kindVolumeSnapshot, Name: "snap"}
+			_, err := p.Provision(options)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				if info, _ := storage.Query("pvc-1"); info != nil {
+					t.Errorf("resource pvc-1 was left behind")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			info, _ := storage.Query("pvc-1")
+			if info == nil {
+				t.Fatalf("resource pvc-1 was not created")
+			}
+			if info.SizeKiB != 1025 {
+				t.Errorf("restored resource has %dKiB, expected 1025KiB", info.SizeKiB)
+			}
+			if nodes := info.DiskfulNodes(); len(nodes) != 1 || nodes[0] != "a" {
+				t.Errorf("restored resource is on %v, expected node a", nodes)
+			}
+		})
+	}
+}
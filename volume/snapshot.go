@@ -0,0 +1,364 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// Annotation of VolumeSnapshotContents with the LINSTOR snapshot name.
+	// The resource, controllers and identity use the PV annotations.
+	annSnapshotName = "linstor.linbit.com/snapshot-name"
+
+	// Events recorded on VolumeSnapshots by the SnapshotController.
+	eventSnapshotCreated      = "SnapshotCreated"
+	eventSnapshotFailed       = "SnapshotFailed"
+	eventSnapshotRefused      = "SnapshotRefused"
+	eventSnapshotContentBound = "SnapshotContentBound"
+
+	// Interval between two polls of the snapshot API.
+	snapshotSyncPeriod = 10 * time.Second
+)
+
+// SnapshotController takes LINSTOR snapshots of VolumeSnapshots whose class
+// names this provisioner as snapshotter. Only PVs owned by this provisioner
+// instance are snapshotted. The LINSTOR snapshot is deleted together with
+// the VolumeSnapshot, unless the deletion policy retains it.
+type SnapshotController struct {
+	provisioner     *flexProvisioner
+	provisionerName string
+	snapshots       *snapshotClient
+	recorder        record.EventRecorder
+}
+
+// NewSnapshotController creates a SnapshotController for the PVs of
+// provisionerName. It shares provisioner, which must have been created by
+// NewFlexProvisioner.
+func NewSnapshotController(provisioner controller.Provisioner, provisionerName string) (*SnapshotController, error) {
+	p, err := sharedProvisioner(provisioner)
+	if err != nil {
+		return nil, err
+	}
+	client := p.client
+
+	return &SnapshotController{
+		provisioner:     p,
+		provisionerName: provisionerName,
+		snapshots:       newSnapshotClient(client),
+		recorder:        newEventRecorder(client, "linstor-snapshotter"),
+	}, nil
+}
+
+// Run polls the snapshot API until stopCh is closed. There are no
+// informers for VolumeSnapshots in client-go.
+func (c *SnapshotController) Run(stopCh <-chan struct{}) {
+	glog.Infof("Starting snapshot controller")
+	wait.Until(c.sync, snapshotSyncPeriod, stopCh)
+}
+
+func (c *SnapshotController) sync() {
+	snaps, err := c.snapshots.listSnapshots()
+	if apierrors.IsNotFound(err) {
+		glog.V(4).Infof("VolumeSnapshots are not available in this cluster")
+		return
+	}
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("unable to list VolumeSnapshots: %v", err))
+		return
+	}
+	for i := range snaps {
+		if err := c.syncSnapshot(&snaps[i]); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error syncing VolumeSnapshot %s/%s: %v", snaps[i].Namespace, snaps[i].Name, err))
+		}
+	}
+
+	contents, err := c.snapshots.listContents()
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("unable to list VolumeSnapshotContents: %v", err))
+		return
+	}
+	for i := range contents {
+		if err := c.syncContent(&contents[i]); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error syncing VolumeSnapshotContent %s: %v", contents[i].Name, err))
+		}
+	}
+}
+
+func (c *SnapshotController) syncSnapshot(snap *volumeSnapshot) error {
+	if snap.DeletionTimestamp != nil || snap.Status.ReadyToUse || snap.Status.Error != nil {
+		return nil
+	}
+	if snap.Spec.VolumeSnapshotClass == nil || *snap.Spec.VolumeSnapshotClass == "" {
+		return nil
+	}
+	class, err := c.snapshots.getClass(*snap.Spec.VolumeSnapshotClass)
+	if err != nil {
+		return err
+	}
+	if class.Snapshotter != c.provisionerName {
+		return nil
+	}
+
+	pv, err := c.sourceVolume(snap)
+	if refusal, ok := err.(snapshotRefusal); ok {
+		return c.refuse(snap, string(refusal))
+	}
+	if err != nil {
+		return err
+	}
+	if pv == nil {
+		// The claim isn't bound yet.
+		return nil
+	}
+
+	resourceName, controllers := resourceOf(pv)
+	snapshotName := "snapshot-" + string(snap.UID)
+	storage, err := c.provisioner.newStorage(controllers)
+	if err != nil {
+		return err
+	}
+	if err := storage.CreateSnapshot(resourceName, snapshotName); err != nil {
+		c.recorder.Event(snapshotRef(snap), v1.EventTypeWarning, eventSnapshotFailed, err.Error())
+		return err
+	}
+	info, err := storage.QuerySnapshot(resourceName, snapshotName)
+	if err != nil {
+		return err
+	}
+	if info == nil || !info.Ready {
+		glog.V(4).Infof("snapshot %s of resource %s is not ready yet", snapshotName, resourceName)
+		return nil
+	}
+
+	content, err := c.ensureContent(snap, class, pv, info)
+	if err != nil {
+		return err
+	}
+
+	restoreSize := apiresource.NewQuantity(int64(info.SizeKiB)*1024, apiresource.BinarySI)
+	creationTime := content.CreationTimestamp
+	snap.Spec.SnapshotContentName = content.Name
+	snap.Status = volumeSnapshotStatus{
+		CreationTime: &creationTime,
+		RestoreSize:  restoreSize,
+		ReadyToUse:   true,
+	}
+	if _, err := c.snapshots.updateSnapshot(snap); err != nil {
+		return fmt.Errorf("unable to update VolumeSnapshot: %v", err)
+	}
+
+	c.recorder.Eventf(snapshotRef(snap), v1.EventTypeNormal, eventSnapshotCreated,
+		"created snapshot %s of resource %s", snapshotName, resourceName)
+	return nil
+}
+
+// snapshotRefusal is the reason a VolumeSnapshot can never be taken by this
+// provisioner instance. Other errors are temporary and retried.
+type snapshotRefusal string
+
+func (r snapshotRefusal) Error() string {
+	return string(r)
+}
+
+// sourceVolume returns the PV bound to the claim snap was taken of, nil if
+// the claim isn't bound yet. It fails with a snapshotRefusal if the source
+// isn't a claim or its PV isn't owned by this provisioner instance.
+func (c *SnapshotController) sourceVolume(snap *volumeSnapshot) (*v1.PersistentVolume, error) {
+	source := snap.Spec.Source
+	if source == nil || source.Kind != "PersistentVolumeClaim" {
+		return nil, snapshotRefusal("only snapshots of PersistentVolumeClaims are supported")
+	}
+
+	client := c.provisioner.client
+	claim, err := client.CoreV1().PersistentVolumeClaims(snap.Namespace).Get(source.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get claim %s: %v", source.Name, err)
+	}
+	if claim.Status.Phase != v1.ClaimBound || claim.Spec.VolumeName == "" {
+		return nil, nil
+	}
+
+	pv, err := client.CoreV1().PersistentVolumes().Get(claim.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get PV %s: %v", claim.Spec.VolumeName, err)
+	}
+	if pv.Annotations[annProvisionedBy] != c.provisionerName {
+		return nil, snapshotRefusal(fmt.Sprintf("PV %s was not provisioned by %s", pv.Name, c.provisionerName))
+	}
+	owned, err := c.provisioner.provisioned(pv)
+	if err != nil {
+		return nil, err
+	}
+	if !owned {
+		return nil, snapshotRefusal(fmt.Sprintf("this provisioner id %s didn't provision PV %s; id %s did",
+			c.provisioner.identity, pv.Name, pv.Annotations[annProvisionerId]))
+	}
+	return pv, nil
+}
+
+// ensureContent returns the VolumeSnapshotContent bound to snap, creating it
+// if necessary.
+func (c *SnapshotController) ensureContent(snap *volumeSnapshot, class *volumeSnapshotClass, pv *v1.PersistentVolume, info *SnapshotInfo) (*volumeSnapshotContent, error) {
+	name := "snapcontent-" + string(snap.UID)
+	content, err := c.snapshots.getContent(name)
+	if err == nil {
+		return content, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	resourceName, controllers := resourceOf(pv)
+	policy := snapshotDeletionPolicyDelete
+	if class.DeletionPolicy != nil {
+		policy = *class.DeletionPolicy
+	}
+	now := time.Now().UnixNano()
+	restoreSize := int64(info.SizeKiB) * 1024
+
+	content = &volumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				annProvisionerId: string(c.provisioner.identity),
+				annResourceName:  resourceName,
+				annControllers:   controllers,
+				annSnapshotName:  info.Name,
+			},
+		},
+		Spec: volumeSnapshotContentSpec{
+			CSI: &csiVolumeSnapshotSource{
+				Driver:         c.provisionerName,
+				SnapshotHandle: snapshotHandle(resourceName, info.Name),
+				CreationTime:   &now,
+				RestoreSize:    &restoreSize,
+			},
+			VolumeSnapshotRef: &v1.ObjectReference{
+				Kind:       kindVolumeSnapshot,
+				APIVersion: snapshotGroupVersion,
+				Namespace:  snap.Namespace,
+				Name:       snap.Name,
+				UID:        snap.UID,
+			},
+			PersistentVolumeRef: &v1.ObjectReference{
+				Kind:       "PersistentVolume",
+				APIVersion: "v1",
+				Name:       pv.Name,
+				UID:        pv.UID,
+			},
+			VolumeSnapshotClass: &class.Name,
+			DeletionPolicy:      &policy,
+		},
+	}
+	content, err = c.snapshots.createContent(content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create VolumeSnapshotContent %s: %v", name, err)
+	}
+	c.recorder.Eventf(snapshotRef(snap), v1.EventTypeNormal, eventSnapshotContentBound,
+		"bound to VolumeSnapshotContent %s", name)
+	return content, nil
+}
+
+// refuse marks snap as failed permanently.
+func (c *SnapshotController) refuse(snap *volumeSnapshot, reason string) error {
+	c.recorder.Event(snapshotRef(snap), v1.EventTypeWarning, eventSnapshotRefused, reason)
+	snap.Status.Error = &volumeSnapshotError{Time: metav1.Now(), Message: reason}
+	if _, err := c.snapshots.updateSnapshot(snap); err != nil {
+		return fmt.Errorf("unable to update VolumeSnapshot: %v", err)
+	}
+	return nil
+}
+
+// syncContent deletes the LINSTOR snapshot and the VolumeSnapshotContent
+// once the VolumeSnapshot it was bound to is gone.
+func (c *SnapshotController) syncContent(content *volumeSnapshotContent) error {
+	if content.Spec.CSI == nil || content.Spec.CSI.Driver != c.provisionerName {
+		return nil
+	}
+	if content.Annotations[annProvisionerId] != string(c.provisioner.identity) {
+		return nil
+	}
+	if content.Spec.DeletionPolicy != nil && *content.Spec.DeletionPolicy == snapshotDeletionPolicyRetain {
+		return nil
+	}
+
+	if ref := content.Spec.VolumeSnapshotRef; ref != nil {
+		snap, err := c.snapshots.getSnapshot(ref.Namespace, ref.Name)
+		if err == nil && snap.UID == ref.UID {
+			return nil
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	resourceName, snapshotName, err := parseSnapshotHandle(content.Spec.CSI.SnapshotHandle)
+	if err != nil {
+		return err
+	}
+	storage, err := c.provisioner.newStorage(content.Annotations[annControllers])
+	if err != nil {
+		return err
+	}
+	if err := storage.DeleteSnapshot(resourceName, snapshotName); err != nil {
+		return err
+	}
+	if err := c.snapshots.deleteContent(content.Name); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to delete VolumeSnapshotContent: %v", err)
+	}
+	glog.Infof("Deleted snapshot %s of resource %s", snapshotName, resourceName)
+	return nil
+}
+
+// snapshotHandle identifies a LINSTOR snapshot in VolumeSnapshotContents.
+func snapshotHandle(resourceName, snapshotName string) string {
+	return resourceName + "/" + snapshotName
+}
+
+func parseSnapshotHandle(handle string) (string, string, error) {
+	parts := strings.Split(handle, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid snapshot handle %q", handle)
+	}
+	return parts[0], parts[1], nil
+}
+
+// snapshotRef returns a reference to snap for recording events. snap isn't
+// registered in the client-go scheme.
+func snapshotRef(snap *volumeSnapshot) *v1.ObjectReference {
+	return &v1.ObjectReference{
+		Kind:            kindVolumeSnapshot,
+		APIVersion:      snapshotGroupVersion,
+		Namespace:       snap.Namespace,
+		Name:            snap.Name,
+		UID:             snap.UID,
+		ResourceVersion: snap.ResourceVersion,
+	}
+}
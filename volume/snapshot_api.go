@@ -0,0 +1,214 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+
+	"k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// The subset of the snapshot.storage.k8s.io/v1alpha1 API used by the
+// SnapshotController. There is no generated client for it in client-go, so
+// the objects are read and written as JSON through the REST client.
+
+const (
+	snapshotGroupVersion = "snapshot.storage.k8s.io/v1alpha1"
+
+	kindVolumeSnapshot        = "VolumeSnapshot"
+	kindVolumeSnapshotContent = "VolumeSnapshotContent"
+
+	snapshotDeletionPolicyDelete = "Delete"
+	snapshotDeletionPolicyRetain = "Retain"
+)
+
+type volumeSnapshotError struct {
+	Time    metav1.Time `json:"time,omitempty"`
+	Message string      `json:"message,omitempty"`
+}
+
+type volumeSnapshotSpec struct {
+	Source              *v1.TypedLocalObjectReference `json:"source,omitempty"`
+	SnapshotContentName string                        `json:"snapshotContentName,omitempty"`
+	VolumeSnapshotClass *string                       `json:"snapshotClassName,omitempty"`
+}
+
+type volumeSnapshotStatus struct {
+	CreationTime *metav1.Time          `json:"creationTime,omitempty"`
+	RestoreSize  *apiresource.Quantity `json:"restoreSize,omitempty"`
+	ReadyToUse   bool                  `json:"readyToUse"`
+	Error        *volumeSnapshotError  `json:"error,omitempty"`
+}
+
+type volumeSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   volumeSnapshotSpec   `json:"spec"`
+	Status volumeSnapshotStatus `json:"status"`
+}
+
+type volumeSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []volumeSnapshot `json:"items"`
+}
+
+type csiVolumeSnapshotSource struct {
+	Driver         string `json:"driver"`
+	SnapshotHandle string `json:"snapshotHandle"`
+	// Nanoseconds since the epoch.
+	CreationTime *int64 `json:"creationTime,omitempty"`
+	// Bytes.
+	RestoreSize *int64 `json:"restoreSize,omitempty"`
+}
+
+type volumeSnapshotContentSpec struct {
+	CSI                 *csiVolumeSnapshotSource `json:"csiVolumeSnapshotSource,omitempty"`
+	VolumeSnapshotRef   *v1.ObjectReference      `json:"volumeSnapshotRef,omitempty"`
+	PersistentVolumeRef *v1.ObjectReference      `json:"persistentVolumeRef,omitempty"`
+	VolumeSnapshotClass *string                  `json:"snapshotClassName,omitempty"`
+	DeletionPolicy      *string                  `json:"deletionPolicy,omitempty"`
+}
+
+type volumeSnapshotContent struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec volumeSnapshotContentSpec `json:"spec"`
+}
+
+type volumeSnapshotContentList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []volumeSnapshotContent `json:"items"`
+}
+
+type volumeSnapshotClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Snapshotter    string            `json:"snapshotter"`
+	Parameters     map[string]string `json:"parameters,omitempty"`
+	DeletionPolicy *string           `json:"deletionPolicy,omitempty"`
+}
+
+// snapshotClient reads and writes snapshot objects.
+type snapshotClient struct {
+	rest rest.Interface
+}
+
+func newSnapshotClient(client kubernetes.Interface) *snapshotClient {
+	return &snapshotClient{rest: client.CoreV1().RESTClient()}
+}
+
+// snapshotPath returns the API path of an object of resource, the collection
+// if name is empty and cluster scoped if namespace is empty.
+func snapshotPath(resource, namespace, name string) []string {
+	path := []string{"/apis", snapshotGroupVersion}
+	if namespace != "" {
+		path = append(path, "namespaces", namespace)
+	}
+	path = append(path, resource)
+	if name != "" {
+		path = append(path, name)
+	}
+	return path
+}
+
+func (c *snapshotClient) do(req *rest.Request, in, out interface{}) error {
+	if in != nil {
+		body, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		req = req.SetHeader("Content-Type", "application/json").Body(body)
+	}
+	data, err := req.DoRaw()
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *snapshotClient) listSnapshots() ([]volumeSnapshot, error) {
+	list := &volumeSnapshotList{}
+	err := c.do(c.rest.Get().AbsPath(snapshotPath("volumesnapshots", "", "")...), nil, list)
+	return list.Items, err
+}
+
+func (c *snapshotClient) getSnapshot(namespace, name string) (*volumeSnapshot, error) {
+	snap := &volumeSnapshot{}
+	if err := c.do(c.rest.Get().AbsPath(snapshotPath("volumesnapshots", namespace, name)...), nil, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+func (c *snapshotClient) updateSnapshot(snap *volumeSnapshot) (*volumeSnapshot, error) {
+	updated := &volumeSnapshot{}
+	req := c.rest.Put().AbsPath(snapshotPath("volumesnapshots", snap.Namespace, snap.Name)...)
+	if err := c.do(req, snap, updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (c *snapshotClient) listContents() ([]volumeSnapshotContent, error) {
+	list := &volumeSnapshotContentList{}
+	err := c.do(c.rest.Get().AbsPath(snapshotPath("volumesnapshotcontents", "", "")...), nil, list)
+	return list.Items, err
+}
+
+func (c *snapshotClient) getContent(name string) (*volumeSnapshotContent, error) {
+	content := &volumeSnapshotContent{}
+	if err := c.do(c.rest.Get().AbsPath(snapshotPath("volumesnapshotcontents", "", name)...), nil, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+func (c *snapshotClient) createContent(content *volumeSnapshotContent) (*volumeSnapshotContent, error) {
+	content.APIVersion = snapshotGroupVersion
+	content.Kind = kindVolumeSnapshotContent
+	created := &volumeSnapshotContent{}
+	if err := c.do(c.rest.Post().AbsPath(snapshotPath("volumesnapshotcontents", "", "")...), content, created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (c *snapshotClient) deleteContent(name string) error {
+	return c.do(c.rest.Delete().AbsPath(snapshotPath("volumesnapshotcontents", "", name)...), nil, nil)
+}
+
+func (c *snapshotClient) getClass(name string) (*volumeSnapshotClass, error) {
+	class := &volumeSnapshotClass{}
+	if err := c.do(c.rest.Get().AbsPath(snapshotPath("volumesnapshotclasses", "", name)...), nil, class); err != nil {
+		return nil, err
+	}
+	return class, nil
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2017 LINBIT USA LLC.
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+)
+
+const defaultDriver = "linbit/linstor-flexvolume"
+
+// volumeSpec describes a single volume to provision. Every Provision call
+// builds its own from the controller.VolumeOptions and completes it while
+// provisioning, e.g. with the settings of the resource group, the source of
+// a restore or the siblings to avoid. It is never shared, so concurrent
+// Provision calls don't share any mutable state.
+type volumeSpec struct {
+	resourceName string
+
+	driver string
+	// Empty for block volumes.
+	fsType string
+	isRO   bool
+	block  bool
+
+	nodeList            []string
+	replicasOnSame      []string
+	replicasOnDifferent []string
+	storagePool         string
+	disklessStoragePool string
+	blockSize           string
+	force               string
+	xfsdiscardblocks    string
+	xfsDataSU           string
+	xfsDataSW           string
+	xfsLogDev           string
+	mountOpts           string
+	fsOpts              string
+	autoPlace           uint64
+	doNotPlaceWithRegex string
+	controllers         string
+	// Cluster profile the controllers are taken from, if any.
+	linstorCluster string
+	requestedSize  uint64
+	encryption     bool
+	// Encrypt with a key of the volume's own instead of one generated by
+	// LINSTOR. The key and the Secret holding it are resolved on creation.
+	volumeKeys      bool
+	volumeKey       string
+	volumeKeySecret string
+	// Factor the free capacity of thin pools is multiplied with.
+	overSubscription float64
+
+	// Resource group new resources are spawned from. Its placement settings
+	// apply where the StorageClass doesn't set any.
+	resourceGroup       string
+	updateResourceGroup bool
+
+	// Node the scheduler picked for the first consumer, if any.
+	selectedNode string
+	topology     topologyConstraints
+
+	// Claims may adopt existing resources.
+	allowAdoption bool
+
+	// Snapshot the volume is restored from, if any.
+	restoreFrom *snapshotSource
+	// Volume the volume is cloned from, if any.
+	cloneFrom *cloneSource
+
+	// Resources of sibling claims and the nodes of their diskful replicas,
+	// which the replicas of the volume avoid.
+	statefulSetAntiAffinity bool
+	antiAffinity            []string
+	avoidNodes              []string
+	// Bound sibling claims whose placement wasn't looked up in dry-run mode.
+	unresolvedSiblings []string
+
+	// Properties of the resource definition.
+	props map[string]string
+
+	// Parameters claims may override, and the overrides of the claim.
+	allowedOverrides []string
+	overrides        map[string]string
+}
+
+// newVolumeSpec parses the StorageClass parameters and the claim of
+// volumeOptions into a new volumeSpec for the resource resourceName.
+func newVolumeSpec(volumeOptions controller.VolumeOptions, resourceName string) (*volumeSpec, error) {
+	s := &volumeSpec{
+		resourceName: resourceName,
+		driver:       defaultDriver,
+		fsType:       "ext4",
+		isRO:         true,
+		props:        map[string]string{},
+
+		overSubscription: 1,
+	}
+
+	params, overrides, err := overrideParameters(volumeOptions.Parameters, volumeOptions.PVC)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseParameters(s, params); err != nil {
+		return nil, err
+	}
+	s.overrides = overrides
+
+	topology, err := newTopologyConstraints(volumeOptions.AllowedTopologies)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range s.nodeList {
+		if !topology.allows(node) {
+			return nil, fmt.Errorf("node %s of nodeList is not in the allowed topologies", node)
+		}
+	}
+	s.topology = topology
+	if volumeOptions.SelectedNode != nil {
+		s.selectedNode = volumeOptions.SelectedNode.Name
+	}
+
+	// Filesystem parameters of the class don't apply to raw block claims.
+	if mode := volumeOptions.PVC.Spec.VolumeMode; mode != nil && *mode == v1.PersistentVolumeBlock {
+		s.block = true
+		s.fsType = ""
+	}
+
+	s.requestedSize = sizeKiB(volumeOptions.PVC.Spec.Resources.Requests[v1.ResourceStorage])
+
+	return s, nil
+}
+
+// placement returns where the diskful replicas of the volume go. Without a
+// node list and autoPlace count a single replica is placed automatically.
+func (s *volumeSpec) placement() Placement {
+	autoPlace := s.autoPlace
+	if autoPlace == 0 && len(s.nodeList) == 0 {
+		autoPlace = 1
+	}
+
+	return Placement{
+		Nodes:               s.nodeList,
+		AutoPlace:           autoPlace,
+		AllowedNodes:        s.topology.nodes,
+		StoragePool:         s.storagePool,
+		DoNotPlaceWithRegex: s.doNotPlaceWithRegex,
+		DoNotPlaceWith:      s.antiAffinity,
+		ReplicasOnSame:      append(append([]string{}, s.replicasOnSame...), s.topology.replicasOnSame...),
+		ReplicasOnDifferent: s.replicasOnDifferent,
+	}
+}
+
+// replicaCount returns the number of diskful replicas of the volume.
+func (s *volumeSpec) replicaCount() uint64 {
+	placement := s.placement()
+	count := uint64(len(placement.Nodes))
+	if placement.AutoPlace > count {
+		count = placement.AutoPlace
+	}
+	return count
+}
+
+// cluster returns the controllers string of the LINSTOR cluster of the
+// volume, which refers to its cluster profile if it has one.
+func (s *volumeSpec) cluster() string {
+	if s.linstorCluster != "" {
+		return clusterProfileRef(s.linstorCluster)
+	}
+	return s.controllers
+}
+
+// volumeEncryption returns how the volume is encrypted, nil if it isn't.
+func (s *volumeSpec) volumeEncryption() *Encryption {
+	if !s.encryption {
+		return nil
+	}
+	return &Encryption{Passphrase: s.volumeKey}
+}
+
+// flexVolumeOptions returns the options passed to the FlexVolume driver.
+func (s *volumeSpec) flexVolumeOptions() map[string]string {
+	opts := map[string]string{
+		"disklessStoragePool": s.disklessStoragePool,
+		"controllers":         s.controllers,
+	}
+	// The driver doesn't resolve cluster profiles yet, so it gets the
+	// controllers of the profile at the time of provisioning as well. They
+	// go stale if the profile changes, see the README.
+	if s.linstorCluster != "" {
+		opts["linstorCluster"] = s.linstorCluster
+	}
+	if s.block {
+		opts["block"] = "true"
+		return opts
+	}
+
+	opts["blockSize"] = s.blockSize
+	opts["force"] = s.force
+	opts["xfsDiscardBlocks"] = s.xfsdiscardblocks
+	opts["xfsDataSU"] = s.xfsDataSU
+	opts["xfsDataSW"] = s.xfsDataSW
+	opts["xfsLogDev"] = s.xfsLogDev
+	opts["fsOpts"] = s.fsOpts
+	opts["mountOpts"] = s.mountOpts
+	return opts
+}
+
+// sizeKiB converts a requested capacity to the KiB LINSTOR volumes are sized
+// in, rounding up.
+func sizeKiB(capacity apiresource.Quantity) uint64 {
+	return uint64((capacity.Value() / 1024) + 1)
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+// Storage is a backend the provisioner creates its volumes in. Volumes are
+// identified by their resource name and consist of a single volume that is
+// replicated to one or more nodes.
+type Storage interface {
+	// CreateDefinition reserves the resource name and sets props on it. It
+	// succeeds if the name is defined already.
+	CreateDefinition(name string, props map[string]string) error
+	// SetSize creates the volume of a defined resource with sizeKiB, or grows
+	// an existing volume to sizeKiB. encryption is only used on creation, nil
+	// creates an unencrypted volume.
+	SetSize(name string, sizeKiB uint64, encryption *Encryption) error
+	// Place deploys diskful replicas of the resource as described by
+	// placement. Nodes that already have a replica are left alone.
+	Place(name string, placement Placement) error
+	// AttachClients deploys diskless replicas of the resource to every node
+	// that doesn't have a replica yet.
+	AttachClients(name string, nodes []string, disklessStoragePool string) error
+	// Delete removes the resource from all nodes. Deleting a resource that
+	// doesn't exist is not an error.
+	Delete(name string) error
+	// List returns all resources of the backend.
+	List() ([]ResourceInfo, error)
+	// Query returns the resource, or nil if it doesn't exist.
+	Query(name string) (*ResourceInfo, error)
+	// CreateSnapshot takes a snapshot of all replicas of the resource. It
+	// succeeds if the snapshot exists already.
+	CreateSnapshot(name, snapshot string) error
+	// DeleteSnapshot removes a snapshot of the resource. Deleting a snapshot
+	// that doesn't exist is not an error.
+	DeleteSnapshot(name, snapshot string) error
+	// QuerySnapshot returns the snapshot, or nil if it doesn't exist.
+	QuerySnapshot(name, snapshot string) (*SnapshotInfo, error)
+	// RestoreSnapshot creates the volume of the defined resource name from a
+	// snapshot of resource source and deploys it to nodes, which must all
+	// hold the snapshot.
+	RestoreSnapshot(name, source, snapshot string, nodes []string) error
+	// StoragePools returns the storage pools of all nodes.
+	StoragePools() ([]StoragePoolInfo, error)
+	// QueryResourceGroup returns the automatic placement settings of a
+	// resource group, or nil if it doesn't exist.
+	QueryResourceGroup(group string) (*Placement, error)
+	// SetResourceGroup creates the resource group or updates its automatic
+	// placement settings. Nodes and AllowedNodes are ignored.
+	SetResourceGroup(group string, placement Placement) error
+	// Spawn defines the resource name with a volume of sizeKiB from the
+	// resource group and sets props on it. Nothing is deployed.
+	Spawn(name, group string, sizeKiB uint64, props map[string]string) error
+	// EnterPassphrase unlocks the encrypted volumes of the backend with its
+	// master passphrase.
+	EnterPassphrase(passphrase string) error
+	// ChangePassphrase replaces the master passphrase old with new.
+	ChangePassphrase(old, new string) error
+}
+
+// Encryption describes how a new volume is encrypted. Without Passphrase
+// the backend generates the key of the volume.
+type Encryption struct {
+	Passphrase string
+}
+
+// Cloner is implemented by Storage backends that can copy a resource
+// directly. Backends without it are cloned through a temporary snapshot.
+type Cloner interface {
+	// Clone creates the volume of the defined resource name as a copy of
+	// resource source.
+	Clone(name, source string) error
+}
+
+// StorageProvider returns the Storage for a comma separated list of LINSTOR
+// controllers as found in StorageClass parameters and PVs.
+type StorageProvider func(controllers string) (Storage, error)
+
+// Placement describes where the diskful replicas of a resource go. Replicas
+// are deployed to every node of Nodes, then AutoPlace replicas are placed
+// automatically using the remaining fields as constraints.
+type Placement struct {
+	Nodes     []string
+	AutoPlace uint64
+	// Nodes automatic placement may choose from, all nodes if empty.
+	AllowedNodes        []string
+	StoragePool         string
+	DoNotPlaceWithRegex string
+	// Resources whose nodes automatic placement avoids.
+	DoNotPlaceWith      []string
+	ReplicasOnSame      []string
+	ReplicasOnDifferent []string
+}
+
+// ResourceInfo describes an existing resource.
+type ResourceInfo struct {
+	Name string
+	// Size of the volume, 0 if the resource has no volume yet.
+	SizeKiB  uint64
+	Props    map[string]string
+	Replicas []Replica
+}
+
+// Replica is a resource deployed to a single node.
+type Replica struct {
+	Node        string
+	StoragePool string
+	Diskless    bool
+}
+
+// StoragePoolInfo describes a storage pool of a node.
+type StoragePoolInfo struct {
+	Name string
+	Node string
+	// Capacities in KiB.
+	FreeKiB  uint64
+	TotalKiB uint64
+	// Thin pools may be over-subscribed.
+	Thin bool
+	// Diskless pools have no capacity.
+	Diskless bool
+}
+
+// SnapshotInfo describes an existing snapshot of a resource.
+type SnapshotInfo struct {
+	Name     string
+	Resource string
+	// Size of the snapshotted volume.
+	SizeKiB uint64
+	// Nodes the snapshot was taken on.
+	Nodes []string
+	// Ready is set once the snapshot was taken on all nodes.
+	Ready bool
+}
+
+// DiskfulNodes returns the nodes of all diskful replicas.
+func (r *ResourceInfo) DiskfulNodes() []string {
+	nodes := []string{}
+	for _, replica := range r.Replicas {
+		if !replica.Diskless {
+			nodes = append(nodes, replica.Node)
+		}
+	}
+	return nodes
+}
+
+// Nodes returns the nodes with a diskful or diskless replica.
+func (r *ResourceInfo) Nodes() []string {
+	nodes := []string{}
+	for _, replica := range r.Replicas {
+		nodes = append(nodes, replica.Node)
+	}
+	return nodes
+}
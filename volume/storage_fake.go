@@ -0,0 +1,434 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// FakeStorage is an in-memory Storage for tests. Automatic placement picks
+// the first nodes of Nodes that don't hold a replica yet and honours
+// AllowedNodes, DoNotPlaceWith and DoNotPlaceWithRegex; ReplicasOnSame and
+// ReplicasOnDifferent are ignored.
+type FakeStorage struct {
+	// Nodes available for automatic placement.
+	Nodes []string
+	// Storage pools reported by StoragePools. Capacity isn't consumed.
+	Pools []StoragePoolInfo
+	// Master passphrase EnterPassphrase accepts.
+	Passphrase string
+
+	mu        sync.Mutex
+	resources map[string]*ResourceInfo
+	snapshots map[string]*SnapshotInfo
+	groups    map[string]Placement
+	errs      map[string]error
+	unlocked  bool
+}
+
+var _ Storage = &FakeStorage{}
+
+// NewFakeStorage returns an empty FakeStorage that places replicas on nodes.
+func NewFakeStorage(nodes ...string) *FakeStorage {
+	return &FakeStorage{
+		Nodes:     nodes,
+		resources: map[string]*ResourceInfo{},
+		snapshots: map[string]*SnapshotInfo{},
+		groups:    map[string]Placement{},
+		errs:      map[string]error{},
+	}
+}
+
+// Provider returns a StorageProvider that always returns f.
+func (f *FakeStorage) Provider() StorageProvider {
+	return func(string) (Storage, error) { return f, nil }
+}
+
+// FailOn makes every following call of the Storage method named method
+// return err. A nil err clears a previous failure.
+func (f *FakeStorage) FailOn(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		delete(f.errs, method)
+		return
+	}
+	f.errs[method] = err
+}
+
+func (f *FakeStorage) CreateDefinition(name string, props map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["CreateDefinition"]; err != nil {
+		return err
+	}
+	if _, ok := f.resources[name]; !ok {
+		r := &ResourceInfo{Name: name, Props: map[string]string{}}
+		for k, v := range props {
+			r.Props[k] = v
+		}
+		f.resources[name] = r
+	}
+	return nil
+}
+
+func (f *FakeStorage) SetSize(name string, sizeKiB uint64, encryption *Encryption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["SetSize"]; err != nil {
+		return err
+	}
+	r, ok := f.resources[name]
+	if !ok {
+		return fmt.Errorf("resource %s is not defined", name)
+	}
+	if sizeKiB > r.SizeKiB {
+		r.SizeKiB = sizeKiB
+	}
+	return nil
+}
+
+func (f *FakeStorage) Place(name string, placement Placement) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["Place"]; err != nil {
+		return err
+	}
+	r, ok := f.resources[name]
+	if !ok {
+		return fmt.Errorf("resource %s is not defined", name)
+	}
+
+	for _, node := range placement.Nodes {
+		f.addReplica(r, Replica{Node: node, StoragePool: placement.StoragePool})
+	}
+
+	var notWith *regexp.Regexp
+	if placement.DoNotPlaceWithRegex != "" {
+		var err error
+		if notWith, err = regexp.Compile(placement.DoNotPlaceWithRegex); err != nil {
+			return err
+		}
+	}
+
+	avoid := []string{}
+	for _, other := range placement.DoNotPlaceWith {
+		if o, ok := f.resources[other]; ok {
+			avoid = append(avoid, o.DiskfulNodes()...)
+		}
+	}
+
+	placed := uint64(len(r.DiskfulNodes()))
+	for _, node := range f.Nodes {
+		if placed >= placement.AutoPlace {
+			break
+		}
+		if len(placement.AllowedNodes) != 0 && !contains(placement.AllowedNodes, node) {
+			continue
+		}
+		if f.hasReplica(r, node) || contains(avoid, node) || (notWith != nil && f.nodeHasMatching(node, notWith)) {
+			continue
+		}
+		f.addReplica(r, Replica{Node: node, StoragePool: placement.StoragePool})
+		placed++
+	}
+	if placed < placement.AutoPlace {
+		return fmt.Errorf("not enough nodes to place %d replicas of resource %s", placement.AutoPlace, name)
+	}
+	return nil
+}
+
+func (f *FakeStorage) AttachClients(name string, nodes []string, disklessStoragePool string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["AttachClients"]; err != nil {
+		return err
+	}
+	r, ok := f.resources[name]
+	if !ok {
+		return fmt.Errorf("resource %s is not defined", name)
+	}
+	for _, node := range nodes {
+		f.addReplica(r, Replica{Node: node, StoragePool: disklessStoragePool, Diskless: true})
+	}
+	return nil
+}
+
+func (f *FakeStorage) Delete(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["Delete"]; err != nil {
+		return err
+	}
+	delete(f.resources, name)
+	return nil
+}
+
+func (f *FakeStorage) List() ([]ResourceInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["List"]; err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(f.resources))
+	for name := range f.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	infos := make([]ResourceInfo, 0, len(names))
+	for _, name := range names {
+		infos = append(infos, *copyResourceInfo(f.resources[name]))
+	}
+	return infos, nil
+}
+
+func (f *FakeStorage) Query(name string) (*ResourceInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["Query"]; err != nil {
+		return nil, err
+	}
+	r, ok := f.resources[name]
+	if !ok {
+		return nil, nil
+	}
+	return copyResourceInfo(r), nil
+}
+
+func (f *FakeStorage) CreateSnapshot(name, snapshot string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["CreateSnapshot"]; err != nil {
+		return err
+	}
+	r, ok := f.resources[name]
+	if !ok {
+		return fmt.Errorf("resource %s is not defined", name)
+	}
+	key := name + "/" + snapshot
+	if _, ok := f.snapshots[key]; !ok {
+		f.snapshots[key] = &SnapshotInfo{
+			Name:     snapshot,
+			Resource: name,
+			SizeKiB:  r.SizeKiB,
+			Nodes:    r.DiskfulNodes(),
+			Ready:    true,
+		}
+	}
+	return nil
+}
+
+func (f *FakeStorage) DeleteSnapshot(name, snapshot string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["DeleteSnapshot"]; err != nil {
+		return err
+	}
+	delete(f.snapshots, name+"/"+snapshot)
+	return nil
+}
+
+func (f *FakeStorage) QuerySnapshot(name, snapshot string) (*SnapshotInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["QuerySnapshot"]; err != nil {
+		return nil, err
+	}
+	s, ok := f.snapshots[name+"/"+snapshot]
+	if !ok {
+		return nil, nil
+	}
+	c := *s
+	c.Nodes = append([]string(nil), s.Nodes...)
+	return &c, nil
+}
+
+func (f *FakeStorage) RestoreSnapshot(name, source, snapshot string, nodes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["RestoreSnapshot"]; err != nil {
+		return err
+	}
+	r, ok := f.resources[name]
+	if !ok {
+		return fmt.Errorf("resource %s is not defined", name)
+	}
+	s, ok := f.snapshots[source+"/"+snapshot]
+	if !ok {
+		return fmt.Errorf("snapshot %s of resource %s does not exist", snapshot, source)
+	}
+	r.SizeKiB = s.SizeKiB
+	for _, node := range nodes {
+		if !contains(s.Nodes, node) {
+			return fmt.Errorf("snapshot %s of resource %s is not on node %s", snapshot, source, node)
+		}
+		f.addReplica(r, Replica{Node: node})
+	}
+	return nil
+}
+
+func (f *FakeStorage) StoragePools() ([]StoragePoolInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["StoragePools"]; err != nil {
+		return nil, err
+	}
+	return append([]StoragePoolInfo(nil), f.Pools...), nil
+}
+
+func (f *FakeStorage) QueryResourceGroup(group string) (*Placement, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["QueryResourceGroup"]; err != nil {
+		return nil, err
+	}
+	placement, ok := f.groups[group]
+	if !ok {
+		return nil, nil
+	}
+	return &placement, nil
+}
+
+func (f *FakeStorage) SetResourceGroup(group string, placement Placement) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["SetResourceGroup"]; err != nil {
+		return err
+	}
+	placement.Nodes = nil
+	placement.AllowedNodes = nil
+	f.groups[group] = placement
+	return nil
+}
+
+func (f *FakeStorage) Spawn(name, group string, sizeKiB uint64, props map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["Spawn"]; err != nil {
+		return err
+	}
+	if _, ok := f.groups[group]; !ok {
+		return fmt.Errorf("resource group %s is not defined", group)
+	}
+	if _, ok := f.resources[name]; ok {
+		return fmt.Errorf("resource %s is already defined", name)
+	}
+	r := &ResourceInfo{Name: name, SizeKiB: sizeKiB, Props: map[string]string{}}
+	for k, v := range props {
+		r.Props[k] = v
+	}
+	f.resources[name] = r
+	return nil
+}
+
+func (f *FakeStorage) EnterPassphrase(passphrase string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["EnterPassphrase"]; err != nil {
+		return err
+	}
+	if passphrase != f.Passphrase {
+		return fmt.Errorf("wrong passphrase")
+	}
+	f.unlocked = true
+	return nil
+}
+
+func (f *FakeStorage) ChangePassphrase(old, new string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.errs["ChangePassphrase"]; err != nil {
+		return err
+	}
+	if old != f.Passphrase {
+		return fmt.Errorf("wrong passphrase")
+	}
+	f.Passphrase = new
+	f.unlocked = true
+	return nil
+}
+
+// Unlocked reports whether the master passphrase was entered.
+func (f *FakeStorage) Unlocked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.unlocked
+}
+
+func (f *FakeStorage) hasReplica(r *ResourceInfo, node string) bool {
+	for _, replica := range r.Replicas {
+		if replica.Node == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FakeStorage) addReplica(r *ResourceInfo, replica Replica) {
+	if !f.hasReplica(r, replica.Node) {
+		r.Replicas = append(r.Replicas, replica)
+	}
+}
+
+// nodeHasMatching reports whether node has a diskful replica of a resource
+// whose name matches re.
+func (f *FakeStorage) nodeHasMatching(node string, re *regexp.Regexp) bool {
+	for name, r := range f.resources {
+		if !re.MatchString(name) {
+			continue
+		}
+		for _, n := range r.DiskfulNodes() {
+			if n == node {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func copyResourceInfo(r *ResourceInfo) *ResourceInfo {
+	c := *r
+	c.Props = map[string]string{}
+	for k, v := range r.Props {
+		c.Props[k] = v
+	}
+	c.Replicas = append([]Replica(nil), r.Replicas...)
+	return &c
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultStoragePool         = "DfltStorPool"
+	defaultDisklessStoragePool = "DfltDisklessStorPool"
+
+	// Property that selects the storage pool of a resource.
+	propStorPoolName = "StorPoolName"
+)
+
+// linstorStorage is the Storage backed by a LINSTOR cluster.
+type linstorStorage struct {
+	client *linstorClient
+}
+
+var _ Storage = &linstorStorage{}
+
+// NewLinstorStorage returns the Storage of the LINSTOR cluster managed by
+// controllers. It is the default StorageProvider.
+func NewLinstorStorage(controllers string) (Storage, error) {
+	c, err := newLinstorClient(controllers)
+	if err != nil {
+		return nil, err
+	}
+	return &linstorStorage{client: c}, nil
+}
+
+func (s *linstorStorage) CreateDefinition(name string, props map[string]string) error {
+	_, err := s.client.getResourceDefinition(name)
+	if isNotFound(err) {
+		err = s.client.createResourceDefinition(resourceDefinition{Name: name, Props: props})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to reserve resource name %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) SetSize(name string, sizeKiB uint64, encryption *Encryption) error {
+	vds, err := s.client.listVolumeDefinitions(name)
+	if err != nil {
+		return fmt.Errorf("unable to list volumes of resource %s: %v", name, err)
+	}
+	for _, vd := range vds {
+		if vd.VolumeNumber != 0 {
+			continue
+		}
+		if vd.SizeKiB >= sizeKiB {
+			return nil
+		}
+		if err := s.client.modifyVolumeDefinition(name, 0, volumeDefinitionModify{SizeKiB: sizeKiB}); err != nil {
+			return fmt.Errorf("unable to resize resource %s to %dKiB: %v", name, sizeKiB, err)
+		}
+		return nil
+	}
+
+	vd := volumeDefinitionCreate{VolumeDefinition: volumeDefinition{SizeKiB: sizeKiB}}
+	if encryption != nil {
+		vd.VolumeDefinition.Flags = []string{flagEncrypted}
+		vd.Passphrase = encryption.Passphrase
+	}
+	if err := s.client.createVolumeDefinition(name, vd); err != nil {
+		return fmt.Errorf("unable to create volume of resource %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) Place(name string, placement Placement) error {
+	storagePool := placement.StoragePool
+	if storagePool == "" {
+		storagePool = defaultStoragePool
+	}
+
+	if err := s.deployToNodes(name, placement.Nodes, storagePool, false); err != nil {
+		return err
+	}
+
+	if placement.AutoPlace == 0 {
+		return nil
+	}
+	err := s.client.autoPlace(name, autoPlaceRequest{
+		SelectFilter: autoSelectFilter{
+			PlaceCount:           placement.AutoPlace,
+			NodeNameList:         placement.AllowedNodes,
+			StoragePool:          storagePool,
+			NotPlaceWithRsc:      placement.DoNotPlaceWith,
+			NotPlaceWithRscRegex: placement.DoNotPlaceWithRegex,
+			ReplicasOnSame:       placement.ReplicasOnSame,
+			ReplicasOnDifferent:  placement.ReplicasOnDifferent,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to autoplace resource %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) AttachClients(name string, nodes []string, disklessStoragePool string) error {
+	if disklessStoragePool == "" {
+		disklessStoragePool = defaultDisklessStoragePool
+	}
+	return s.deployToNodes(name, nodes, disklessStoragePool, true)
+}
+
+// deployToNodes creates the resource on every node in nodes that doesn't
+// have it yet, either backed by storagePool or diskless.
+func (s *linstorStorage) deployToNodes(name string, nodes []string, storagePool string, diskless bool) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	existing, err := s.client.listResources(name)
+	if err != nil {
+		return fmt.Errorf("unable to assign resource %s, failed to list its resources: %v", name, err)
+	}
+	present := map[string]bool{}
+	for _, r := range existing {
+		present[r.NodeName] = true
+	}
+
+	for _, node := range nodes {
+		if present[node] {
+			continue
+		}
+		r := resource{
+			Name:     name,
+			NodeName: node,
+			Props:    map[string]string{propStorPoolName: storagePool},
+		}
+		if diskless {
+			r.Flags = []string{flagDiskless}
+		}
+		if err := s.client.createResource(r); err != nil {
+			return fmt.Errorf("unable to assign resource %s to node %s: %v", name, node, err)
+		}
+		present[node] = true
+	}
+
+	return nil
+}
+
+func (s *linstorStorage) Delete(name string) error {
+	err := s.client.deleteResourceDefinition(name)
+	if isNotFound(err) {
+		glog.Infof("resource %s is not defined, nothing to delete", name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete resource %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) List() ([]ResourceInfo, error) {
+	rds, err := s.client.listResourceDefinitions()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list resources: %v", err)
+	}
+
+	infos := make([]ResourceInfo, 0, len(rds))
+	for _, rd := range rds {
+		info, err := s.resourceInfo(rd)
+		if isNotFound(err) {
+			// Deleted while we were listing.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+func (s *linstorStorage) Query(name string) (*ResourceInfo, error) {
+	rd, err := s.client.getResourceDefinition(name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query resource %s: %v", name, err)
+	}
+
+	info, err := s.resourceInfo(*rd)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return info, err
+}
+
+func (s *linstorStorage) resourceInfo(rd resourceDefinition) (*ResourceInfo, error) {
+	info := &ResourceInfo{Name: rd.Name, Props: rd.Props}
+
+	vds, err := s.client.listVolumeDefinitions(rd.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, vd := range vds {
+		if vd.VolumeNumber == 0 {
+			info.SizeKiB = vd.SizeKiB
+		}
+	}
+
+	rs, err := s.client.listResources(rd.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		info.Replicas = append(info.Replicas, Replica{
+			Node:        r.NodeName,
+			StoragePool: r.Props[propStorPoolName],
+			Diskless:    r.diskless(),
+		})
+	}
+
+	return info, nil
+}
+
+func (s *linstorStorage) CreateSnapshot(name, snap string) error {
+	_, err := s.client.getSnapshot(name, snap)
+	if isNotFound(err) {
+		err = s.client.createSnapshot(name, snapshot{Name: snap})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create snapshot %s of resource %s: %v", snap, name, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) DeleteSnapshot(name, snap string) error {
+	err := s.client.deleteSnapshot(name, snap)
+	if isNotFound(err) {
+		glog.Infof("snapshot %s of resource %s does not exist, nothing to delete", snap, name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete snapshot %s of resource %s: %v", snap, name, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) QuerySnapshot(name, snap string) (*SnapshotInfo, error) {
+	sn, err := s.client.getSnapshot(name, snap)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query snapshot %s of resource %s: %v", snap, name, err)
+	}
+
+	info := &SnapshotInfo{
+		Name:     sn.Name,
+		Resource: name,
+		Nodes:    sn.Nodes,
+		Ready:    contains(sn.Flags, flagSuccessful),
+	}
+	for _, vd := range sn.VolumeDefinitions {
+		if vd.VolumeNumber == 0 {
+			info.SizeKiB = vd.SizeKiB
+		}
+	}
+	return info, nil
+}
+
+func (s *linstorStorage) RestoreSnapshot(name, source, snap string, nodes []string) error {
+	if err := s.client.restoreVolumeDefinitions(source, snap, snapshotRestore{ToResource: name}); err != nil {
+		return fmt.Errorf("unable to restore volumes of snapshot %s of resource %s to %s: %v", snap, source, name, err)
+	}
+	if err := s.client.restoreResources(source, snap, snapshotRestore{ToResource: name, Nodes: nodes}); err != nil {
+		return fmt.Errorf("unable to restore snapshot %s of resource %s to %s: %v", snap, source, name, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) StoragePools() ([]StoragePoolInfo, error) {
+	pools, err := s.client.listStoragePools()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list storage pools: %v", err)
+	}
+
+	infos := make([]StoragePoolInfo, 0, len(pools))
+	for _, pool := range pools {
+		info := StoragePoolInfo{
+			Name:     pool.StoragePoolName,
+			Node:     pool.NodeName,
+			Thin:     pool.ProviderKind == providerLvmThin || pool.ProviderKind == providerZfsThin,
+			Diskless: pool.ProviderKind == providerDiskless,
+		}
+		if pool.FreeCapacity > 0 {
+			info.FreeKiB = uint64(pool.FreeCapacity)
+		}
+		if pool.TotalCapacity > 0 {
+			info.TotalKiB = uint64(pool.TotalCapacity)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (s *linstorStorage) QueryResourceGroup(group string) (*Placement, error) {
+	rg, err := s.client.getResourceGroup(group)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to query resource group %s: %v", group, err)
+	}
+
+	f := rg.SelectFilter
+	return &Placement{
+		AutoPlace:           f.PlaceCount,
+		StoragePool:         f.StoragePool,
+		DoNotPlaceWithRegex: f.NotPlaceWithRscRegex,
+		ReplicasOnSame:      f.ReplicasOnSame,
+		ReplicasOnDifferent: f.ReplicasOnDifferent,
+	}, nil
+}
+
+func (s *linstorStorage) SetResourceGroup(group string, placement Placement) error {
+	filter := autoSelectFilter{
+		PlaceCount:           placement.AutoPlace,
+		StoragePool:          placement.StoragePool,
+		NotPlaceWithRscRegex: placement.DoNotPlaceWithRegex,
+		ReplicasOnSame:       placement.ReplicasOnSame,
+		ReplicasOnDifferent:  placement.ReplicasOnDifferent,
+	}
+
+	_, err := s.client.getResourceGroup(group)
+	if isNotFound(err) {
+		err = s.client.createResourceGroup(resourceGroup{Name: group, SelectFilter: filter})
+	} else if err == nil {
+		err = s.client.modifyResourceGroup(group, resourceGroupModify{SelectFilter: filter})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to set up resource group %s: %v", group, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) Spawn(name, group string, sizeKiB uint64, props map[string]string) error {
+	err := s.client.spawnResourceGroup(group, resourceGroupSpawn{
+		ResourceDefinitionName: name,
+		VolumeSizes:            []uint64{sizeKiB},
+		DefinitionsOnly:        true,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to spawn resource %s from resource group %s: %v", name, group, err)
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	if err := s.client.modifyResourceDefinition(name, resourceDefinitionModify{OverrideProps: props}); err != nil {
+		return fmt.Errorf("unable to set properties of resource %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) EnterPassphrase(passphrase string) error {
+	if err := s.client.enterPassphrase(passphrase); err != nil {
+		return fmt.Errorf("unable to enter the encryption passphrase: %v", err)
+	}
+	return nil
+}
+
+func (s *linstorStorage) ChangePassphrase(old, new string) error {
+	if err := s.client.changePassphrase(passphraseModify{NewPassphrase: new, OldPassphrase: old}); err != nil {
+		return fmt.Errorf("unable to change the encryption passphrase: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLinstorPassphrase(t *testing.T) {
+	type request struct {
+		method string
+		path   string
+		body   string
+	}
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, request{method: r.Method, path: r.URL.Path, body: string(body)})
+	}))
+	defer server.Close()
+	client, err := newLinstorClient(server.URL)
+	if err != nil {
+		t.Fatalf("unable to create client: %v", err)
+	}
+	storage := &linstorStorage{client: client}
+
+	if err := storage.EnterPassphrase("secret"); err != nil {
+		t.Fatalf("unlocking: %v", err)
+	}
+	if err := storage.ChangePassphrase("secret", "new secret"); err != nil {
+		t.Fatalf("rotating: %v", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("got requests %v, expected 2", requests)
+	}
+	unlock := requests[0]
+	if unlock.method != "PATCH" || unlock.path != "/v1/encryption/passphrase" || unlock.body != `"secret"` {
+		t.Errorf("unlocking sent %+v", unlock)
+	}
+	rotate := requests[1]
+	if rotate.method != "PUT" || rotate.path != "/v1/encryption/passphrase" {
+		t.Errorf("rotating sent %+v", rotate)
+	}
+	var m passphraseModify
+	if err := json.Unmarshal([]byte(rotate.body), &m); err != nil {
+		t.Fatalf("rotating sent invalid body %q: %v", rotate.body, err)
+	}
+	if m.OldPassphrase != "secret" || m.NewPassphrase != "new secret" {
+		t.Errorf("rotating sent %+v", m)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2018 LINBIT USA LLC.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+)
+
+// LINSTOR nodes are expected to be named like the Kubernetes nodes.
+const labelHostname = "kubernetes.io/hostname"
+
+// topologyConstraints are the AllowedTopologies of a StorageClass translated
+// into LINSTOR placement constraints.
+type topologyConstraints struct {
+	// Nodes replicas may be placed on, all nodes if empty.
+	nodes []string
+	// Auxiliary node properties all replicas have to share.
+	replicasOnSame []string
+}
+
+// newTopologyConstraints translates AllowedTopologies. Terms that only
+// select hostnames become a node list. Other labels map to auxiliary LINSTOR
+// node properties of the same name, which can only be expressed for a single
+// term with a single value per label.
+func newTopologyConstraints(terms []v1.TopologySelectorTerm) (topologyConstraints, error) {
+	c := topologyConstraints{}
+
+	for _, term := range terms {
+		for _, req := range term.MatchLabelExpressions {
+			if req.Key == labelHostname {
+				c.nodes = append(c.nodes, req.Values...)
+				continue
+			}
+			if len(terms) != 1 || len(req.Values) != 1 {
+				return c, fmt.Errorf("allowed topology label %q can only be used with a single term and value", req.Key)
+			}
+			c.replicasOnSame = append(c.replicasOnSame, fmt.Sprintf("Aux/%s=%s", req.Key, req.Values[0]))
+		}
+	}
+	c.nodes = uniq(c.nodes)
+
+	return c, nil
+}
+
+// allows reports whether replicas may be placed on node.
+func (c topologyConstraints) allows(node string) bool {
+	return len(c.nodes) == 0 || contains(c.nodes, node)
+}
+
+// nodeAffinity returns the PV node affinity matching AllowedTopologies, nil
+// if there are none.
+func nodeAffinity(terms []v1.TopologySelectorTerm) *v1.VolumeNodeAffinity {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	selector := &v1.NodeSelector{}
+	for _, term := range terms {
+		nodeTerm := v1.NodeSelectorTerm{}
+		for _, req := range term.MatchLabelExpressions {
+			nodeTerm.MatchExpressions = append(nodeTerm.MatchExpressions, v1.NodeSelectorRequirement{
+				Key:      req.Key,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   req.Values,
+			})
+		}
+		selector.NodeSelectorTerms = append(selector.NodeSelectorTerms, nodeTerm)
+	}
+
+	return &v1.VolumeNodeAffinity{Required: selector}
+}
+
+// restrictToNodes adds the requirement that pods run on one of nodes to
+// every term of affinity, which may be nil.
+func restrictToNodes(affinity *v1.VolumeNodeAffinity, nodes []string) *v1.VolumeNodeAffinity {
+	if affinity == nil {
+		affinity = &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{
+			NodeSelectorTerms: []v1.NodeSelectorTerm{{}},
+		}}
+	}
+	req := v1.NodeSelectorRequirement{
+		Key:      labelHostname,
+		Operator: v1.NodeSelectorOpIn,
+		Values:   nodes,
+	}
+	for i := range affinity.Required.NodeSelectorTerms {
+		term := &affinity.Required.NodeSelectorTerms[i]
+		term.MatchExpressions = append(term.MatchExpressions, req)
+	}
+	return affinity
+}
+
+// placeVolume deploys the replicas of spec and makes sure the node selected
+// by the scheduler has one. It gets a diskful replica if the placement allows
+// for it, a diskless one otherwise.
+func placeVolume(storage Storage, spec *volumeSpec) error {
+	placement := spec.placement()
+	if spec.selectedNode == "" || contains(placement.Nodes, spec.selectedNode) {
+		return storage.Place(spec.resourceName, placement)
+	}
+
+	if placement.AutoPlace > 0 && spec.topology.allows(spec.selectedNode) && !contains(spec.avoidNodes, spec.selectedNode) {
+		preferred := placement
+		preferred.Nodes = append([]string{spec.selectedNode}, placement.Nodes...)
+		err := storage.Place(spec.resourceName, preferred)
+		if err == nil {
+			return nil
+		}
+		glog.Warningf("unable to place a diskful replica of %s on selected node %s, attaching it diskless: %v",
+			spec.resourceName, spec.selectedNode, err)
+	}
+
+	if err := storage.Place(spec.resourceName, placement); err != nil {
+		return err
+	}
+	return storage.AttachClients(spec.resourceName, []string{spec.selectedNode}, spec.disklessStoragePool)
+}
+
+// uniq removes duplicates from a []string.
+func uniq(strs []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, s := range strs {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}